@@ -202,8 +202,13 @@ impl Execute for AuthGet {
 
         info!(concat!(
             "\tUser: {}\n",
-            "\tHas Password: {}\n"
-        ), response.user, response.has_password);
+            "\tHas Password: {}\n",
+            "\tAuthorized Keys: {}\n"
+        ), response.user, response.has_password, response.authorized_keys.len());
+
+        for authorized_key in response.authorized_keys {
+            info!("\t\t{}", authorized_key)
+        }
 
         Ok(())
     }
@@ -219,7 +224,9 @@ struct AuthSet {
     #[structopt(long, help = "The container username")]
     user: Option<String>,
     #[structopt(long, help = "The container password. If empty, the authentication gets removed")]
-    password: Option<String>
+    password: Option<String>,
+    #[structopt(long = "authorized-key", help = "A public key in the authorized_keys format which is allowed to log in. Replaces all existing keys")]
+    authorized_keys: Vec<String>
 }
 
 impl Execute for AuthSet {
@@ -227,6 +234,9 @@ impl Execute for AuthSet {
         let mut request = request::AuthPostRequest::new();
         request.body.user = self.user;
         request.body.password = self.password.clone();
+        if !self.authorized_keys.is_empty() {
+            request.body.authorized_keys = Some(self.authorized_keys);
+        }
 
         request.request(api)?;
 
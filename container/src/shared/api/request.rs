@@ -167,7 +167,9 @@ impl ConfigPostRequest {
 #[derive(Deserialize)]
 pub struct AuthGetResponse {
     pub user: String,
-    pub has_password: bool
+    pub has_password: bool,
+    #[serde(default)]
+    pub authorized_keys: Vec<String>
 }
 
 pub struct AuthGetRequest {
@@ -190,7 +192,8 @@ impl AuthGetRequest {
 #[derive(Serialize)]
 pub struct AuthPostBody {
     pub user: Option<String>,
-    pub password: Option<String>
+    pub password: Option<String>,
+    pub authorized_keys: Option<Vec<String>>
 }
 
 pub struct AuthPostRequest {
@@ -207,7 +210,8 @@ impl AuthPostRequest {
             request,
             body: AuthPostBody{
                 user: None,
-                password: None
+                password: None,
+                authorized_keys: None
             }
         }
     }
@@ -4,23 +4,40 @@ import (
 	"docker4ssh/database"
 	"docker4ssh/ssh"
 	"encoding/json"
+	"fmt"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
+	s "golang.org/x/crypto/ssh"
 	"net/http"
+	"strings"
 )
 
 type authGetResponse struct {
-	User        string `json:"user"`
-	HasPassword bool   `json:"has_password"`
+	User           string   `json:"user"`
+	HasPassword    bool     `json:"has_password"`
+	AuthorizedKeys []string `json:"authorized_keys"`
 }
 
 func AuthGet(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface{}, int) {
-	auth, ok := database.GetDatabase().GetAuthByContainer(user.Container.FullContainerID)
+	container := user.Container()
+	if container == nil {
+		return containerStoppedError, http.StatusNotFound
+	}
+	auth, ok := database.GetDatabase().GetAuthByContainer(container.FullContainerID)
 
 	if ok {
+		authorizedKeys := make([]string, 0)
+		if auth.AuthorizedKeys != nil {
+			for _, authorizedKey := range strings.Split(*auth.AuthorizedKeys, "\n") {
+				if authorizedKey != "" {
+					authorizedKeys = append(authorizedKeys, authorizedKey)
+				}
+			}
+		}
 		return authGetResponse{
-			User:        *auth.User,
-			HasPassword: auth.Password != nil,
+			User:           *auth.User,
+			HasPassword:    auth.Password != nil,
+			AuthorizedKeys: authorizedKeys,
 		}, http.StatusOK
 	} else {
 		return APIError{Message: "no auth is set"}, http.StatusNotFound
@@ -28,8 +45,9 @@ func AuthGet(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface{
 }
 
 type authPostRequest struct {
-	User     *string `json:"user"`
-	Password *string `json:"password"`
+	User           *string   `json:"user"`
+	Password       *string   `json:"password"`
+	AuthorizedKeys *[]string `json:"authorized_keys"`
 }
 
 func AuthPost(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface{}, int) {
@@ -37,28 +55,57 @@ func AuthPost(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface
 	json.NewDecoder(r.Body).Decode(&request)
 	defer r.Body.Close()
 
+	container := user.Container()
+	if container == nil {
+		return containerStoppedError, http.StatusNotFound
+	}
+
 	db := database.GetDatabase()
 
-	auth, _ := db.GetAuthByContainer(user.Container.FullContainerID)
+	auth, _ := db.GetAuthByContainer(container.FullContainerID)
 
 	if request.User != nil {
 		if *request.User == "" {
 			return APIError{Message: "new username cannot be empty"}, http.StatusNotAcceptable
 		}
-		if err := db.SetAuth(user.Container.FullContainerID, database.Auth{
+		if err := db.SetAuth(container.FullContainerID, database.Auth{
 			User: request.User,
 		}); err != nil {
 			zap.S().Errorf("Error while updating user for user %s: %v", user.ID, err)
 			return APIError{Message: "failed to process user"}, http.StatusInternalServerError
 		}
-		zap.S().Infof("Updated password for %s", user.Container.ContainerID)
+		zap.S().Infof("Updated password for %s", container.ContainerID)
+	}
+	if request.AuthorizedKeys != nil {
+		var authorizedKeys []string
+		for _, authorizedKey := range *request.AuthorizedKeys {
+			key, comment, _, _, err := s.ParseAuthorizedKey([]byte(authorizedKey))
+			if err != nil {
+				return APIError{Message: fmt.Sprintf("invalid authorized key '%s'", authorizedKey)}, http.StatusNotAcceptable
+			}
+			// normalize the key to prevent multiline or otherwise malformed entries in the database
+			authorizedKeys = append(authorizedKeys, strings.TrimSpace(fmt.Sprintf("%s %s", strings.TrimSpace(string(s.MarshalAuthorizedKey(key))), comment)))
+		}
+		rawAuthorizedKeys := strings.Join(authorizedKeys, "\n")
+		keyAuth := database.Auth{
+			AuthorizedKeys: &rawAuthorizedKeys,
+		}
+		if auth.User == nil && request.User == nil {
+			// a username is required to find the container on public key authentication
+			keyAuth.User = &container.FullContainerID
+		}
+		if err := db.SetAuth(container.FullContainerID, keyAuth); err != nil {
+			zap.S().Errorf("Error while updating authorized keys for user %s: %v", user.ID, err)
+			return APIError{Message: "failed to process authorized keys"}, http.StatusInternalServerError
+		}
+		zap.S().Infof("Updated authorized keys for %s", container.ContainerID)
 	}
 	if request.Password != nil && *request.Password == "" {
-		if err := db.DeleteAuth(user.Container.FullContainerID); err != nil {
+		if err := db.DeleteAuth(container.FullContainerID); err != nil {
 			zap.S().Errorf("Error while deleting auth for user %s: %v", user.ID, err)
 			return APIError{Message: "failed to delete auth"}, http.StatusInternalServerError
 		}
-		zap.S().Infof("Deleted authenticiation for %s", user.Container.ContainerID)
+		zap.S().Infof("Deleted authenticiation for %s", container.ContainerID)
 	} else if request.Password != nil {
 		pwd, err := bcrypt.GenerateFromPassword([]byte(*request.Password), bcrypt.DefaultCost)
 		if err != nil {
@@ -67,14 +114,14 @@ func AuthPost(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface
 		}
 		var username string
 		if auth.User == nil {
-			username = user.Container.FullContainerID
+			username = container.FullContainerID
 		} else {
 			username = *auth.User
 		}
-		if err = db.SetAuth(user.Container.FullContainerID, database.NewUnsafeAuth(username, pwd)); err != nil {
+		if err = db.SetAuth(container.FullContainerID, database.NewUnsafeAuth(username, pwd)); err != nil {
 			return APIError{Message: "failed to update authentication"}, http.StatusInternalServerError
 		}
-		zap.S().Infof("Updated password for %s", user.Container.ContainerID)
+		zap.S().Infof("Updated password for %s", container.ContainerID)
 	}
 	return nil, http.StatusOK
 }
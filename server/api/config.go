@@ -22,7 +22,11 @@ type configGetResponse struct {
 }
 
 func ConfigGet(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface{}, int) {
-	config := user.Container.Config()
+	container := user.Container()
+	if container == nil {
+		return containerStoppedError, http.StatusNotFound
+	}
+	config := container.Config()
 
 	return configGetResponse{
 		config.NetworkMode,
@@ -56,7 +60,11 @@ func ConfigPost(w http.ResponseWriter, r *http.Request, user *ssh.User) (interfa
 	var change bool
 	var response configPostResponse
 
-	updatedConfig := user.Container.Config()
+	container := user.Container()
+	if container == nil {
+		return containerStoppedError, http.StatusNotFound
+	}
+	updatedConfig := container.Config()
 
 	for k, v := range requestBody {
 		if v == nil {
@@ -114,7 +122,7 @@ func ConfigPost(w http.ResponseWriter, r *http.Request, user *ssh.User) (interfa
 			return response, http.StatusNotAcceptable
 		}
 	} else if change {
-		if err := user.Container.UpdateConfig(context.Background(), updatedConfig); err != nil {
+		if err := container.UpdateConfig(context.Background(), updatedConfig); err != nil {
 			zap.S().Errorf("Error while updating config for API user %s: %v", user.ID, err)
 			response.Message = "Internal error while updating the config"
 			return response, http.StatusInternalServerError
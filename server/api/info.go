@@ -10,7 +10,12 @@ type infoGetResponse struct {
 }
 
 func InfoGet(w http.ResponseWriter, r *http.Request, user *ssh.User) (interface{}, int) {
+	container := user.Container()
+	if container == nil {
+		return containerStoppedError, http.StatusNotFound
+	}
+
 	return infoGetResponse{
-		ContainerID: user.Container.FullContainerID,
+		ContainerID: container.FullContainerID,
 	}, http.StatusOK
 }
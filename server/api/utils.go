@@ -10,6 +10,10 @@ type APIError struct {
 	Message string `json:"message"`
 }
 
+// containerStoppedError is returned if the container of the user was stopped
+// while the request was handled
+var containerStoppedError = APIError{Message: "the container is not running"}
+
 func structJsonLookup(v interface{}) (map[string]reflect.Kind, error) {
 	rt := reflect.TypeOf(v)
 	if rt.Kind() != reflect.Struct {
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	c "docker4ssh/config"
+	"docker4ssh/database"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "Manage ips which are banned because of too many failed authentications",
+}
+
+var bansListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all active bans",
+	Args:  cobra.MaximumNArgs(0),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return bansList()
+	},
+}
+
+var bansClearCmd = &cobra.Command{
+	Use:   "clear [ip...]",
+	Short: "Remove the bans of the given ips or all bans if no ip is given",
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return bansClear(args)
+	},
+}
+
+var bansConfigFileFlag string
+
+func bansList() error {
+	db, err := openBansDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	bans, err := db.GetBans()
+	if err != nil {
+		return err
+	}
+	if len(bans) == 0 {
+		fmt.Println("No active bans")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tUNTIL\tREASON")
+	for _, ban := range bans {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ban.IP, ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+	return w.Flush()
+}
+
+func bansClear(ips []string) error {
+	db, err := openBansDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(ips) == 0 {
+		deleted, err := db.DeleteBans()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d ban(s)\n", deleted)
+		return nil
+	}
+
+	for _, ip := range ips {
+		deleted, err := db.DeleteBan(ip)
+		if err != nil {
+			return err
+		} else if !deleted {
+			fmt.Printf("%s is not banned\n", ip)
+		} else {
+			fmt.Printf("Removed ban of %s\n", ip)
+		}
+	}
+	return nil
+}
+
+func openBansDatabase() (*database.Database, error) {
+	config, err := c.LoadConfig(bansConfigFileFlag, false)
+	if err != nil {
+		return nil, err
+	}
+	return database.NewSqlite3Connection(config.Database.Sqlite3File)
+}
+
+func init() {
+	rootCmd.AddCommand(bansCmd)
+
+	bansCmd.PersistentFlags().StringVarP(&bansConfigFileFlag, "file", "f", "/etc/docker4ssh/docker4ssh.conf", "Specify the config file which contains the database location")
+	bansCmd.AddCommand(bansListCmd)
+	bansCmd.AddCommand(bansClearCmd)
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"bufio"
+	c "docker4ssh/config"
+	"docker4ssh/terminal"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var recordingsCmd = &cobra.Command{
+	Use:   "recordings",
+	Short: "List and replay recorded sessions",
+}
+
+var recordingsListCmd = &cobra.Command{
+	Use:   "list [container id]",
+	Short: "List all recordings or the recordings of a container",
+	Args:  cobra.MaximumNArgs(1),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var containerID string
+		if len(args) > 0 {
+			containerID = args[0]
+		}
+		return recordingsList(containerID)
+	},
+}
+
+var recordingsPlayCmd = &cobra.Command{
+	Use:   "play <id>",
+	Short: "Replay a recording in the terminal",
+	Args:  cobra.ExactArgs(1),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return recordingsPlay(args[0])
+	},
+}
+
+var (
+	recordingsConfigFileFlag string
+	recordingsSpeedFlag      float64
+	recordingsIdleLimitFlag  time.Duration
+)
+
+// recording is an asciicast v2 file in the recording directory
+type recording struct {
+	ID       string
+	File     string
+	Header   terminal.RecordingHeader
+	Duration time.Duration
+}
+
+func recordingsList(containerID string) error {
+	dir, err := recordingsDir()
+	if err != nil {
+		return err
+	}
+
+	pattern := filepath.Join(dir, "*", "*.cast")
+	if containerID != "" {
+		pattern = filepath.Join(dir, containerID, "*.cast")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Println("No recordings found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tDURATION\tTITLE")
+	for _, file := range files {
+		rec, err := readRecording(dir, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read recording %s: %v\n", file, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", rec.ID, time.Unix(rec.Header.Timestamp, 0).Format(time.RFC3339), rec.Duration.Round(time.Second), rec.Header.Title)
+	}
+	return w.Flush()
+}
+
+func recordingsPlay(id string) error {
+	if recordingsSpeedFlag <= 0 {
+		return fmt.Errorf("speed must be greater than 0")
+	}
+
+	// the id may also be the path to a recording file
+	file := id
+	if _, err := os.Stat(file); err != nil {
+		dir, err := recordingsDir()
+		if err != nil {
+			return err
+		}
+		file = filepath.Join(dir, strings.TrimSuffix(id, ".cast")+".cast")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return playRecording(f, os.Stdout, recordingsSpeedFlag, recordingsIdleLimitFlag)
+}
+
+// playRecording writes the output events of the asciicast v2 recording in r
+// to w in the pace they were recorded, accelerated by speed. Pauses longer
+// than idleLimit are shortened to it if it is greater than 0
+func playRecording(r io.Reader, w io.Writer, speed float64, idleLimit time.Duration) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("recording is empty")
+	}
+	var header terminal.RecordingHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return fmt.Errorf("failed to parse recording header: %v", err)
+	} else if header.Version != 2 {
+		return fmt.Errorf("unsupported recording version %d", header.Version)
+	}
+
+	var last time.Duration
+	for scanner.Scan() {
+		at, code, data, err := parseRecordingEvent(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if code != "o" {
+			// input is already contained in the output (echo) and the local
+			// terminal cannot be resized
+			continue
+		}
+
+		wait := at - last
+		if idleLimit > 0 && wait > idleLimit {
+			wait = idleLimit
+		}
+		time.Sleep(time.Duration(float64(wait) / speed))
+		last = at
+
+		if _, err = io.WriteString(w, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readRecording reads the header and the duration of the recording file in
+// dir
+func readRecording(dir, file string) (*recording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	rec := &recording{File: file}
+	if relative, err := filepath.Rel(dir, file); err == nil {
+		rec.ID = strings.TrimSuffix(filepath.ToSlash(relative), ".cast")
+	}
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("recording is empty")
+	}
+	if err = json.Unmarshal(scanner.Bytes(), &rec.Header); err != nil {
+		return nil, fmt.Errorf("failed to parse recording header: %v", err)
+	}
+	for scanner.Scan() {
+		// the last event may be incomplete if the server did not shut down
+		// properly, the events before are still valid
+		if at, _, _, err := parseRecordingEvent(scanner.Bytes()); err == nil {
+			rec.Duration = at
+		}
+	}
+	return rec, scanner.Err()
+}
+
+// parseRecordingEvent parses an asciicast v2 event line
+func parseRecordingEvent(line []byte) (at time.Duration, code, data string, err error) {
+	var event []interface{}
+	if err = json.Unmarshal(line, &event); err != nil {
+		return 0, "", "", fmt.Errorf("failed to parse recording event: %v", err)
+	}
+	if len(event) != 3 {
+		return 0, "", "", fmt.Errorf("invalid recording event: %s", line)
+	}
+	seconds, ok1 := event[0].(float64)
+	code, ok2 := event[1].(string)
+	data, ok3 := event[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, "", "", fmt.Errorf("invalid recording event: %s", line)
+	}
+	return time.Duration(seconds * float64(time.Second)), code, data, nil
+}
+
+func recordingsDir() (string, error) {
+	config, err := c.LoadConfig(recordingsConfigFileFlag, false)
+	if err != nil {
+		return "", err
+	}
+	if config.Recording.Dir == "" {
+		return "", fmt.Errorf("recording is not enabled (recording.Dir is not set)")
+	}
+	return config.Recording.Dir, nil
+}
+
+func init() {
+	rootCmd.AddCommand(recordingsCmd)
+
+	recordingsCmd.PersistentFlags().StringVarP(&recordingsConfigFileFlag, "file", "f", "/etc/docker4ssh/docker4ssh.conf", "Specify the config file which contains the recording directory")
+	recordingsCmd.AddCommand(recordingsListCmd)
+	recordingsCmd.AddCommand(recordingsPlayCmd)
+
+	recordingsPlayCmd.Flags().Float64VarP(&recordingsSpeedFlag, "speed", "s", 1, "Playback speed, e.g. 2 for double speed")
+	recordingsPlayCmd.Flags().DurationVarP(&recordingsIdleLimitFlag, "idle-limit", "i", 0, "Shorten pauses longer than this duration, e.g. 2s. 0 keeps all pauses")
+}
@@ -86,7 +86,8 @@ func preStart() error {
 func start() {
 	config := c.GetConfig()
 
-	if config.SSH.Passphrase == "" {
+	// generated host keys are unique to this installation, so a missing passphrase is no problem there
+	if _, generated := config.HostKeyfiles(); config.SSH.Passphrase == "" && !generated {
 		zap.S().Warn("YOU HAVE AN EMPTY PASSPHRASE WHICH IS INSECURE, SUGGESTING CREATING A NEW SSH KEY WITH A PASSPHRASE.\n" +
 			"IF YOU'RE DOWNLOADED THIS VERSION FROM THE RELEASES (https://github.com/ByteDream/docker4ssh/releases/latest), MAKE SURE TO CHANGE YOUR SSH KEY IMMEDIATELY BECAUSE ANYONE COULD DECRYPT THE SSH SESSION!!\n" +
 			"USE 'ssh-keygen -t ed25519 -f /etc/docker4ssh/docker4ssh.key -b 4096' AND UPDATE THE PASSPHRASE IN /etc/docker4ssh/docker4ssh.conf UNDER ssh.Passphrase")
@@ -103,7 +104,7 @@ func start() {
 	zap.S().Infof("Started api serving on port %d", config.Api.Port)
 
 	done := make(chan struct{})
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGUSR1, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		s := <-sig
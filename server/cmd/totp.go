@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	c "docker4ssh/config"
+	"docker4ssh/database"
+	"docker4ssh/docker"
+	"docker4ssh/utils"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+var totpCmd = &cobra.Command{
+	Use:   "totp",
+	Short: "Manage totp secrets which are required as second authentication factor",
+}
+
+var totpEnrollCmd = &cobra.Command{
+	Use:   "enroll",
+	Short: "Generate a new totp secret and show it as otpauth uri and qr code",
+	Args:  cobra.MaximumNArgs(0),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return totpEnroll()
+	},
+}
+
+var (
+	totpEnrollConfigFileFlag string
+	totpEnrollContainerFlag  string
+	totpEnrollAccountFlag    string
+)
+
+func totpEnroll() error {
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	account := totpEnrollAccountFlag
+	if totpEnrollContainerFlag != "" {
+		containerID, err := storeContainerTOTPSecret(totpEnrollContainerFlag, secret)
+		if err != nil {
+			return err
+		}
+		if account == "" {
+			account = containerID[:12]
+		}
+	} else if account == "" {
+		account = "docker4ssh"
+	}
+
+	uri := utils.TOTPURI("docker4ssh", account, secret)
+	qr, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(qr.ToSmallString(false))
+	fmt.Println(uri)
+	fmt.Println()
+	if totpEnrollContainerFlag != "" {
+		fmt.Printf("Stored the totp secret for container %s\n", account)
+	} else {
+		fmt.Printf("Add the following line to the profile which should require the totp code:\nTOTPSecret = \"%s\"\n", secret)
+	}
+
+	return nil
+}
+
+// storeContainerTOTPSecret saves the secret for the container in the
+// database and returns the full id of the container
+func storeContainerTOTPSecret(container, secret string) (string, error) {
+	config, err := c.LoadConfig(totpEnrollConfigFileFlag, false)
+	if err != nil {
+		return "", err
+	}
+
+	cli, err := docker.InitCli()
+	if err != nil {
+		return "", err
+	}
+	inspect, err := cli.ContainerInspect(context.Background(), container)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := database.NewSqlite3Connection(config.Database.Sqlite3File)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	// the secret is only a second factor and must not create a new way to
+	// log in to the container
+	if _, exists := db.GetAuthByContainer(inspect.ID); !exists {
+		return "", fmt.Errorf("container %s has no authentication configured", container)
+	}
+	if err = db.SetAuth(inspect.ID, database.Auth{TOTPSecret: &secret}); err != nil {
+		return "", err
+	}
+	return inspect.ID, nil
+}
+
+func init() {
+	rootCmd.AddCommand(totpCmd)
+
+	totpCmd.AddCommand(totpEnrollCmd)
+	totpEnrollCmd.Flags().StringVarP(&totpEnrollConfigFileFlag, "file", "f", "/etc/docker4ssh/docker4ssh.conf", "Specify the config file which contains the database location")
+	totpEnrollCmd.Flags().StringVarP(&totpEnrollContainerFlag, "container", "c", "", "Store the secret for a saved container in the database instead of printing it for a profile")
+	totpEnrollCmd.Flags().StringVarP(&totpEnrollAccountFlag, "account", "a", "", "The account name which is shown in the authenticator app")
+}
@@ -16,23 +16,41 @@ type Config struct {
 	Profile struct {
 		Dir     string `toml:"Dir"`
 		Default struct {
-			Password           string `toml:"Password"`
-			NetworkMode        int    `toml:"NetworkMode"`
-			Configurable       bool   `toml:"Configurable"`
-			RunLevel           int    `toml:"RunLevel"`
-			StartupInformation bool   `toml:"StartupInformation"`
-			ExitAfter          string `toml:"ExitAfter"`
-			KeepOnExit         bool   `toml:"KeepOnExit"`
+			Password           string   `toml:"Password"`
+			NetworkMode        int      `toml:"NetworkMode"`
+			Configurable       bool     `toml:"Configurable"`
+			RunLevel           int      `toml:"RunLevel"`
+			StartupInformation bool     `toml:"StartupInformation"`
+			ExitAfter          string   `toml:"ExitAfter"`
+			KeepOnExit         bool     `toml:"KeepOnExit"`
+			ForwardAnyHost     bool     `toml:"ForwardAnyHost"`
+			AcceptEnv          []string `toml:"AcceptEnv"`
+			IdleTimeout        string   `toml:"IdleTimeout"`
+			MaxSessionDuration string   `toml:"MaxSessionDuration"`
+			Detachable         bool     `toml:"Detachable"`
+			Banner             string   `toml:"Banner"`
+			Motd               string   `toml:"Motd"`
 		} `toml:"default"`
 		Dynamic struct {
-			Enable             bool   `toml:"Enable"`
-			Password           string `toml:"Password"`
-			NetworkMode        int    `toml:"NetworkMode"`
-			Configurable       bool   `toml:"Configurable"`
-			RunLevel           int    `toml:"RunLevel"`
-			StartupInformation bool   `toml:"StartupInformation"`
-			ExitAfter          string `toml:"ExitAfter"`
-			KeepOnExit         bool   `toml:"KeepOnExit"`
+			Enable             bool     `toml:"Enable"`
+			Password           string   `toml:"Password"`
+			NetworkMode        int      `toml:"NetworkMode"`
+			Configurable       bool     `toml:"Configurable"`
+			RunLevel           int      `toml:"RunLevel"`
+			StartupInformation bool     `toml:"StartupInformation"`
+			ExitAfter          string   `toml:"ExitAfter"`
+			KeepOnExit         bool     `toml:"KeepOnExit"`
+			ForwardAnyHost     bool     `toml:"ForwardAnyHost"`
+			AuthorizedKeys     []string `toml:"AuthorizedKeys"`
+			AcceptEnv          []string `toml:"AcceptEnv" json:",omitempty"`
+			TOTPSecret         string   `toml:"TOTPSecret" json:",omitempty"`
+			AllowFrom          []string `toml:"AllowFrom"`
+			DenyFrom           []string `toml:"DenyFrom"`
+			IdleTimeout        string   `toml:"IdleTimeout" json:",omitempty"`
+			MaxSessionDuration string   `toml:"MaxSessionDuration" json:",omitempty"`
+			Detachable         bool     `toml:"Detachable"`
+			Banner             string   `toml:"Banner" json:",omitempty"`
+			Motd               string   `toml:"Motd" json:",omitempty"`
 		} `toml:"dynamic"`
 	} `toml:"profile"`
 	Api struct {
@@ -43,10 +61,43 @@ type Config struct {
 		} `toml:"configure"`
 	} `toml:"api"`
 	SSH struct {
-		Port       uint16 `toml:"Port"`
-		Keyfile    string `toml:"Keyfile"`
-		Passphrase string `toml:"Passphrase"`
+		Port              uint16   `toml:"Port"`
+		Keyfile           string   `toml:"Keyfile"`
+		Keyfiles          []string `toml:"Keyfiles"`
+		HostKeyDir        string   `toml:"HostKeyDir"`
+		Passphrase        string   `toml:"Passphrase"`
+		SocketDir         string   `toml:"SocketDir"`
+		TrustedUserCAKeys string   `toml:"TrustedUserCAKeys"`
+		RevokedSerials    string   `toml:"RevokedSerials"`
+		ProxyProtocol     bool     `toml:"ProxyProtocol"`
+		TrustedProxies    []string `toml:"TrustedProxies"`
+		SFTP              struct {
+			Binary string `toml:"Binary"`
+		} `toml:"sftp"`
+		Shadow struct {
+			ViewerKeys  []string `toml:"ViewerKeys"`
+			CopilotKeys []string `toml:"CopilotKeys"`
+		} `toml:"shadow"`
+		Crypto struct {
+			Preset            string   `toml:"Preset"`
+			KeyExchanges      []string `toml:"KeyExchanges"`
+			Ciphers           []string `toml:"Ciphers"`
+			MACs              []string `toml:"MACs"`
+			HostKeyAlgorithms []string `toml:"HostKeyAlgorithms"`
+			MaxAuthTries      int      `toml:"MaxAuthTries"`
+		} `toml:"crypto"`
+		Limit struct {
+			MaxAuthFailures    int    `toml:"MaxAuthFailures"`
+			FailureWindow      string `toml:"FailureWindow"`
+			BanDuration        string `toml:"BanDuration"`
+			MaxUnauthenticated int    `toml:"MaxUnauthenticated"`
+			MaxHandshakes      int    `toml:"MaxHandshakes"`
+		} `toml:"limit"`
 	} `toml:"ssh"`
+	Recording struct {
+		Dir   string `toml:"Dir"`
+		Input bool   `toml:"Input"`
+	} `toml:"recording"`
 	Database struct {
 		Sqlite3File string `toml:"Sqlite3File"`
 	} `toml:"Database"`
@@ -96,7 +147,32 @@ func LoadConfig(file string, includeEnv bool) (*Config, error) {
 	config.Profile.Dir = absoluteFile(dir, config.Profile.Dir)
 	config.Api.Configure.Binary = absoluteFile(dir, config.Api.Configure.Binary)
 	config.Api.Configure.Man = absoluteFile(dir, config.Api.Configure.Man)
-	config.SSH.Keyfile = absoluteFile(dir, config.SSH.Keyfile)
+	if config.SSH.Keyfile != "" {
+		config.SSH.Keyfile = absoluteFile(dir, config.SSH.Keyfile)
+	}
+	for i, keyfile := range config.SSH.Keyfiles {
+		config.SSH.Keyfiles[i] = absoluteFile(dir, keyfile)
+	}
+	if config.SSH.HostKeyDir != "" {
+		config.SSH.HostKeyDir = absoluteFile(dir, config.SSH.HostKeyDir)
+	} else {
+		config.SSH.HostKeyDir = dir
+	}
+	if config.SSH.SocketDir != "" {
+		config.SSH.SocketDir = absoluteFile(dir, config.SSH.SocketDir)
+	}
+	if config.SSH.TrustedUserCAKeys != "" {
+		config.SSH.TrustedUserCAKeys = absoluteFile(dir, config.SSH.TrustedUserCAKeys)
+	}
+	if config.SSH.RevokedSerials != "" {
+		config.SSH.RevokedSerials = absoluteFile(dir, config.SSH.RevokedSerials)
+	}
+	if config.SSH.SFTP.Binary != "" {
+		config.SSH.SFTP.Binary = absoluteFile(dir, config.SSH.SFTP.Binary)
+	}
+	if config.Recording.Dir != "" {
+		config.Recording.Dir = absoluteFile(dir, config.Recording.Dir)
+	}
 	config.Database.Sqlite3File = absoluteFile(dir, config.Database.Sqlite3File)
 	config.Logging.OutputFile = absoluteFile(dir, config.Logging.OutputFile)
 	config.Logging.ErrorFile = absoluteFile(dir, config.Logging.ErrorFile)
@@ -110,6 +186,28 @@ func LoadConfig(file string, includeEnv bool) (*Config, error) {
 	return config, nil
 }
 
+// GeneratedHostKeyTypes are the key types of the host keys which are
+// generated if no keyfile is configured
+var GeneratedHostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// HostKeyfiles returns all configured host keyfiles. If none are configured,
+// the host keys are generated and the paths of the generated keys in
+// HostKeyDir are returned with generated set to true
+func (c *Config) HostKeyfiles() (keyfiles []string, generated bool) {
+	if c.SSH.Keyfile != "" {
+		keyfiles = append(keyfiles, c.SSH.Keyfile)
+	}
+	keyfiles = append(keyfiles, c.SSH.Keyfiles...)
+	if len(keyfiles) > 0 {
+		return keyfiles, false
+	}
+
+	for _, keyType := range GeneratedHostKeyTypes {
+		keyfiles = append(keyfiles, filepath.Join(c.SSH.HostKeyDir, fmt.Sprintf("ssh_host_%s_key", keyType)))
+	}
+	return keyfiles, true
+}
+
 func absoluteFile(path, file string) string {
 	if filepath.IsAbs(file) {
 		return file
@@ -165,6 +263,13 @@ func envParseField(prefix string, value reflect.Value) error {
 				continue
 			}
 			expected = "true / false (boolean)"
+		case reflect.Int:
+			i, err := strconv.Atoi(val)
+			if err == nil {
+				rff.SetInt(int64(i))
+				continue
+			}
+			expected = "number (int)"
 		case reflect.Uint16:
 			ui, err := strconv.ParseUint(val, 10, 16)
 			if err == nil {
@@ -172,6 +277,18 @@ func envParseField(prefix string, value reflect.Value) error {
 				continue
 			}
 			expected = "number (uint16)"
+		case reflect.Slice:
+			if rff.Type().Elem().Kind() == reflect.String {
+				var values []string
+				for _, v := range strings.Split(val, ",") {
+					if v = strings.TrimSpace(v); v != "" {
+						values = append(values, v)
+					}
+				}
+				rff.Set(reflect.ValueOf(values))
+				continue
+			}
+			return fmt.Errorf("parsed not implemented config type '%s'", rff.Type())
 		default:
 			return fmt.Errorf("parsed not implemented config type '%s'", rff.Kind())
 		}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+// CryptoAlgorithms are the algorithms the ssh server is allowed to use.
+// Empty lists mean that the defaults of the ssh library are used
+type CryptoAlgorithms struct {
+	KeyExchanges      []string
+	Ciphers           []string
+	MACs              []string
+	HostKeyAlgorithms []string
+}
+
+// The known algorithms are all algorithms which are supported by the server
+// side of the ssh library
+var (
+	KnownKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	KnownCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	KnownMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+	KnownHostKeyAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+	}
+)
+
+var modernCryptoPreset = CryptoAlgorithms{
+	KeyExchanges: []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256",
+		"diffie-hellman-group16-sha512",
+	},
+	Ciphers: []string{
+		"chacha20-poly1305@openssh.com",
+		"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+		"aes256-ctr", "aes192-ctr", "aes128-ctr",
+	},
+	MACs: []string{
+		"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+	},
+	HostKeyAlgorithms: []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	},
+}
+
+// CryptoPresets are the named algorithm sets which can be used as
+// ssh.crypto.Preset. 'modern' only contains algorithms without known
+// weaknesses, 'compatible' additionally allows sha1 based and cbc algorithms
+// for old clients
+var CryptoPresets = map[string]CryptoAlgorithms{
+	"modern": modernCryptoPreset,
+	"compatible": {
+		KeyExchanges:      append(append([]string{}, modernCryptoPreset.KeyExchanges...), "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1"),
+		Ciphers:           append(append([]string{}, modernCryptoPreset.Ciphers...), "aes128-cbc"),
+		MACs:              append(append([]string{}, modernCryptoPreset.MACs...), "hmac-sha2-512", "hmac-sha2-256", "hmac-sha1"),
+		HostKeyAlgorithms: append(append([]string{}, modernCryptoPreset.HostKeyAlgorithms...), ssh.KeyAlgoRSA),
+	},
+}
+
+// CryptoAlgorithms returns the algorithms of the configured preset, every
+// explicitly configured algorithm list replaces the one of the preset
+func (c *Config) CryptoAlgorithms() (CryptoAlgorithms, error) {
+	crypto := c.SSH.Crypto
+
+	var algorithms CryptoAlgorithms
+	if crypto.Preset != "" {
+		preset, ok := CryptoPresets[crypto.Preset]
+		if !ok {
+			return CryptoAlgorithms{}, fmt.Errorf("unknown crypto preset '%s'", crypto.Preset)
+		}
+		algorithms = preset
+	}
+
+	if len(crypto.KeyExchanges) > 0 {
+		algorithms.KeyExchanges = crypto.KeyExchanges
+	}
+	if len(crypto.Ciphers) > 0 {
+		algorithms.Ciphers = crypto.Ciphers
+	}
+	if len(crypto.MACs) > 0 {
+		algorithms.MACs = crypto.MACs
+	}
+	if len(crypto.HostKeyAlgorithms) > 0 {
+		algorithms.HostKeyAlgorithms = crypto.HostKeyAlgorithms
+	}
+
+	return algorithms, nil
+}
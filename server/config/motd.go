@@ -0,0 +1,87 @@
+package config
+
+import (
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMotdTemplate is the motd which is shown if neither the profile nor
+// the default profile has one
+const DefaultMotdTemplate = `{{box "Container" "Information"
+	(printf "Container ID: %s" .ContainerID)
+	(printf "Network Mode: %s" .NetworkMode)
+	(printf "Configurable: %t" .Configurable)
+	(printf "Run Level:    %s" .RunLevel)
+	(printf "Exit After:   %s" .ExitAfter)
+	(printf "Keep On Exit: %t" .KeepOnExit)}}`
+
+// MotdData is the data a motd template is rendered with
+type MotdData struct {
+	ContainerID     string
+	FullContainerID string
+	Image           string
+	IP              string
+	NetworkMode     string
+	Configurable    bool
+	RunLevel        string
+	ExitAfter       string
+	KeepOnExit      bool
+	User            string
+	Profile         string
+	// Sessions is the number of active sessions in the container, including
+	// the new one
+	Sessions int
+	// Expires is the time the session ends because of the maximal session
+	// duration. Zero if the session duration is unlimited
+	Expires time.Time
+}
+
+var motdFuncs = template.FuncMap{
+	"box": motdBox,
+}
+
+// ParseMotd parses a motd template. If text is empty, DefaultMotdTemplate is
+// parsed
+func ParseMotd(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultMotdTemplate
+	}
+	return template.New("motd").Funcs(motdFuncs).Parse(text)
+}
+
+// DefaultMotd returns the parsed motd of the default profile. An invalid
+// template is reported by the config validator and falls back to
+// DefaultMotdTemplate here
+func DefaultMotd(config *Config) *template.Template {
+	motd, err := ParseMotd(config.Profile.Default.Motd)
+	if err != nil {
+		motd, _ = ParseMotd("")
+	}
+	return motd
+}
+
+// motdBox draws a frame around the lines, with the title in the upper and
+// the footer in the lower border. The frame grows with the longest line
+func motdBox(title, footer string, lines ...string) string {
+	width := 28
+	for _, line := range lines {
+		if length := utf8.RuneCountInString(line) + 2; length > width {
+			width = length
+		}
+	}
+	for _, label := range []string{title, footer} {
+		if length := utf8.RuneCountInString(label) + 6; length > width {
+			width = length
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("┌───" + title + strings.Repeat("─", width-3-utf8.RuneCountInString(title)) + "┐\n")
+	for _, line := range lines {
+		b.WriteString("│ " + line + strings.Repeat(" ", width-2-utf8.RuneCountInString(line)) + " │\n")
+	}
+	b.WriteString("└" + strings.Repeat("─", width-3-utf8.RuneCountInString(footer)) + footer + "───┘\n")
+	return b.String()
+}
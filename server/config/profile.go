@@ -1,18 +1,24 @@
 package config
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"docker4ssh/utils"
 	"encoding/json"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
 	"hash"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 )
 
 type Profile struct {
@@ -28,13 +34,27 @@ type Profile struct {
 	KeepOnExit         bool
 	Image              string
 	ContainerID        string
+	AuthorizedKeys     []ssh.PublicKey
+	ForwardAnyHost     bool
+	AcceptEnv          []string
+	TOTPSecret         string
+	AllowFrom          []*net.IPNet
+	DenyFrom           []*net.IPNet
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+	Detachable         bool
+	Banner             string
+	Motd               *template.Template
 }
 
 func (p *Profile) Name() string {
 	return p.name
 }
 
-func (p *Profile) Match(user string, password []byte) bool {
+func (p *Profile) Match(user string, password []byte, addr net.Addr) bool {
+	if !p.AllowsAddress(addr) {
+		return false
+	}
 	// username should only be nil if profile was generated from Config.Profile.Dynamic
 	if p.Username == nil || p.Username.MatchString(user) {
 		if p.passwordHashAlgo != nil {
@@ -45,6 +65,64 @@ func (p *Profile) Match(user string, password []byte) bool {
 	return false
 }
 
+// MatchPublicKey checks if the user matches the profile username and if the
+// key is one of the profile's authorized keys
+func (p *Profile) MatchPublicKey(user string, key ssh.PublicKey, addr net.Addr) bool {
+	if !p.AllowsAddress(addr) {
+		return false
+	}
+	if p.Username == nil || p.Username.MatchString(user) {
+		for _, authorizedKey := range p.AuthorizedKeys {
+			if bytes.Equal(authorizedKey.Marshal(), key.Marshal()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchUsername checks if the user matches the profile username. Always false
+// for the dynamic profile since it has no username
+func (p *Profile) MatchUsername(user string, addr net.Addr) bool {
+	return p.Username != nil && p.Username.MatchString(user) && p.AllowsAddress(addr)
+}
+
+// AllowsAddress checks if a connection from addr may use the profile. addr
+// must not be in DenyFrom and, if AllowFrom is not empty, must be in AllowFrom
+func (p *Profile) AllowsAddress(addr net.Addr) bool {
+	ip := addressIP(addr)
+	if ip == nil {
+		// an unknown address can't be checked against the rules
+		return len(p.AllowFrom) == 0 && len(p.DenyFrom) == 0
+	}
+
+	for _, network := range p.DenyFrom {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.AllowFrom) == 0 {
+		return true
+	}
+	for _, network := range p.AllowFrom {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsEnv checks if the environment variable name matches one of the
+// profile's AcceptEnv patterns
+func (p *Profile) AcceptsEnv(name string) bool {
+	for _, pattern := range p.AcceptEnv {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 type preProfile struct {
 	Username           string
 	Password           string
@@ -56,6 +134,17 @@ type preProfile struct {
 	KeepOnExit         bool
 	Image              string
 	Container          string
+	AuthorizedKeys     []string
+	ForwardAnyHost     bool
+	AcceptEnv          []string
+	TOTPSecret         string
+	AllowFrom          []string
+	DenyFrom           []string
+	IdleTimeout        string
+	MaxSessionDuration string
+	Detachable         bool
+	Banner             string
+	Motd               string
 }
 
 func LoadProfileFile(path string, defaultPreProfile preProfile) (Profiles, error) {
@@ -135,6 +224,61 @@ func parseRawProfile(rawProfile map[string]interface{}, path string, defaultPreP
 			return nil, fmt.Errorf("failed to parse %s profile password regex for conf file %s: %v", key, path, err)
 		}
 
+		authorizedKeys, err := parseAuthorizedKeys(pp.AuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s profile authorized keys for conf file %s: %v", key, path, err)
+		}
+
+		if pp.AcceptEnv == nil {
+			pp.AcceptEnv = defaultPreProfile.AcceptEnv
+		}
+		for _, pattern := range pp.AcceptEnv {
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("failed to parse %s profile accept env pattern '%s' for conf file %s: %v", key, pattern, path, err)
+			}
+		}
+
+		if pp.TOTPSecret != "" {
+			if err = utils.CheckTOTPSecret(pp.TOTPSecret); err != nil {
+				return nil, fmt.Errorf("failed to parse %s profile totp secret for conf file %s: %v", key, path, err)
+			}
+		}
+
+		allowFrom, err := parseCIDRs(pp.AllowFrom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s profile allow from for conf file %s: %v", key, path, err)
+		}
+		denyFrom, err := parseCIDRs(pp.DenyFrom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s profile deny from for conf file %s: %v", key, path, err)
+		}
+
+		if pp.IdleTimeout == "" {
+			pp.IdleTimeout = defaultPreProfile.IdleTimeout
+		}
+		idleTimeout, err := parseOptionalDuration(pp.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s profile idle timeout for conf file %s: %v", key, path, err)
+		}
+		if pp.MaxSessionDuration == "" {
+			pp.MaxSessionDuration = defaultPreProfile.MaxSessionDuration
+		}
+		maxSessionDuration, err := parseOptionalDuration(pp.MaxSessionDuration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s profile max session duration for conf file %s: %v", key, path, err)
+		}
+
+		if pp.Banner == "" {
+			pp.Banner = defaultPreProfile.Banner
+		}
+		if pp.Motd == "" {
+			pp.Motd = defaultPreProfile.Motd
+		}
+		motd, err := ParseMotd(pp.Motd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s profile motd for conf file %s: %v", key, path, err)
+		}
+
 		if (pp.Image == "") == (pp.Container == "") {
 			return nil, fmt.Errorf("failed to interpret %s profile image / container definition for conf file %s: `Image` or `Container` must be specified, not both nor none of them", key, path)
 		}
@@ -152,6 +296,17 @@ func parseRawProfile(rawProfile map[string]interface{}, path string, defaultPreP
 			KeepOnExit:         pp.KeepOnExit,
 			Image:              pp.Image,
 			ContainerID:        pp.Container,
+			AuthorizedKeys:     authorizedKeys,
+			ForwardAnyHost:     pp.ForwardAnyHost,
+			AcceptEnv:          pp.AcceptEnv,
+			TOTPSecret:         pp.TOTPSecret,
+			AllowFrom:          allowFrom,
+			DenyFrom:           denyFrom,
+			IdleTimeout:        idleTimeout,
+			MaxSessionDuration: maxSessionDuration,
+			Detachable:         pp.Detachable,
+			Banner:             pp.Banner,
+			Motd:               motd,
 		})
 		count++
 		zap.S().Debugf("Pre-loaded profile %s (%d)", key, count)
@@ -170,9 +325,29 @@ func (ps Profiles) GetByName(name string) (*Profile, bool) {
 	return nil, false
 }
 
-func (ps Profiles) Match(user string, password []byte) (*Profile, bool) {
+func (ps Profiles) Match(user string, password []byte, addr net.Addr) (*Profile, bool) {
 	for _, profile := range ps {
-		if profile.Match(user, password) {
+		if profile.Match(user, password, addr) {
+			return profile, true
+		}
+	}
+	return nil, false
+}
+
+func (ps Profiles) MatchPublicKey(user string, key ssh.PublicKey, addr net.Addr) (*Profile, bool) {
+	for _, profile := range ps {
+		if profile.MatchPublicKey(user, key, addr) {
+			return profile, true
+		}
+	}
+	return nil, false
+}
+
+// MatchUsername returns the first profile whose username matches user and
+// which allows connections from addr
+func (ps Profiles) MatchUsername(user string, addr net.Addr) (*Profile, bool) {
+	for _, profile := range ps {
+		if profile.MatchUsername(user, addr) {
 			return profile, true
 		}
 	}
@@ -190,6 +365,13 @@ func DefaultPreProfileFromConfig(config *Config) preProfile {
 		StartupInformation: defaultProfile.StartupInformation,
 		ExitAfter:          defaultProfile.ExitAfter,
 		KeepOnExit:         defaultProfile.KeepOnExit,
+		ForwardAnyHost:     defaultProfile.ForwardAnyHost,
+		AcceptEnv:          defaultProfile.AcceptEnv,
+		IdleTimeout:        defaultProfile.IdleTimeout,
+		MaxSessionDuration: defaultProfile.MaxSessionDuration,
+		Detachable:         defaultProfile.Detachable,
+		Banner:             defaultProfile.Banner,
+		Motd:               defaultProfile.Motd,
 	}
 }
 
@@ -216,6 +398,35 @@ func DynamicProfileFromConfig(config *Config, defaultPreProfile preProfile) (Pro
 	if err != nil {
 		return Profile{}, fmt.Errorf("failed to parse password regex: %v ", err)
 	}
+	authorizedKeys, err := parseAuthorizedKeys(defaultPreProfile.AuthorizedKeys)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to parse authorized keys: %v", err)
+	}
+	if defaultPreProfile.TOTPSecret != "" {
+		if err = utils.CheckTOTPSecret(defaultPreProfile.TOTPSecret); err != nil {
+			return Profile{}, fmt.Errorf("failed to parse totp secret: %v", err)
+		}
+	}
+	allowFrom, err := parseCIDRs(defaultPreProfile.AllowFrom)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to parse allow from: %v", err)
+	}
+	denyFrom, err := parseCIDRs(defaultPreProfile.DenyFrom)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to parse deny from: %v", err)
+	}
+	idleTimeout, err := parseOptionalDuration(defaultPreProfile.IdleTimeout)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to parse idle timeout: %v", err)
+	}
+	maxSessionDuration, err := parseOptionalDuration(defaultPreProfile.MaxSessionDuration)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to parse max session duration: %v", err)
+	}
+	motd, err := ParseMotd(defaultPreProfile.Motd)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to parse motd: %v", err)
+	}
 
 	return Profile{
 		name:               "",
@@ -228,9 +439,87 @@ func DynamicProfileFromConfig(config *Config, defaultPreProfile preProfile) (Pro
 		StartupInformation: defaultPreProfile.StartupInformation,
 		ExitAfter:          defaultPreProfile.ExitAfter,
 		KeepOnExit:         defaultPreProfile.KeepOnExit,
+		AuthorizedKeys:     authorizedKeys,
+		ForwardAnyHost:     defaultPreProfile.ForwardAnyHost,
+		AcceptEnv:          defaultPreProfile.AcceptEnv,
+		TOTPSecret:         defaultPreProfile.TOTPSecret,
+		AllowFrom:          allowFrom,
+		DenyFrom:           denyFrom,
+		IdleTimeout:        idleTimeout,
+		MaxSessionDuration: maxSessionDuration,
+		Detachable:         defaultPreProfile.Detachable,
+		Banner:             defaultPreProfile.Banner,
+		Motd:               motd,
 	}, nil
 }
 
+// DefaultSessionLimits returns the parsed default idle timeout and maximal
+// session duration. Invalid values are reported by the config validator and
+// disable the limit here
+func DefaultSessionLimits(config *Config) (idleTimeout, maxSessionDuration time.Duration) {
+	idleTimeout, _ = parseOptionalDuration(config.Profile.Default.IdleTimeout)
+	maxSessionDuration, _ = parseOptionalDuration(config.Profile.Default.MaxSessionDuration)
+	return
+}
+
+// parseAuthorizedKeys parses every entry as line in the authorized_keys format
+// (e.g. 'ssh-ed25519 AAAA... comment')
+func parseAuthorizedKeys(rawKeys []string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, rawKey := range rawKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rawKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid authorized key '%s': %v", rawKey, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// parseCIDRs parses every entry as network in the cidr notation (e.g.
+// '10.8.0.0/24')
+func parseCIDRs(rawCIDRs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, rawCIDR := range rawCIDRs {
+		_, network, err := net.ParseCIDR(rawCIDR)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseOptionalDuration parses a duration like '30m'. An empty string is
+// parsed as 0, which disables the limit the duration is used for
+func parseOptionalDuration(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, err
+	} else if duration < 0 {
+		return 0, fmt.Errorf("duration must not be negative")
+	}
+	return duration, nil
+}
+
+// addressIP returns the ip of addr or nil if it has none
+func addressIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
 func getHash(password string) (algo hash.Hash, raw string) {
 	split := strings.SplitN(password, ":", 1)
 
@@ -1,12 +1,19 @@
 package database
 
 import (
+	"bytes"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 )
 
 type Auth struct {
 	User     *string `json:"user"`
 	Password *[]byte `json:"password"`
+	// AuthorizedKeys contains newline separated public keys in the authorized_keys format
+	AuthorizedKeys *string `json:"authorized_keys"`
+	// TOTPSecret is the base32 encoded totp secret which is required as
+	// second factor if set
+	TOTPSecret *string `json:"totp_secret"`
 }
 
 func NewAuth(user string, password []byte) (Auth, error) {
@@ -15,8 +22,8 @@ func NewAuth(user string, password []byte) (Auth, error) {
 		return Auth{}, err
 	}
 	return Auth{
-		&user,
-		&hash,
+		User:     &user,
+		Password: &hash,
 	}, nil
 }
 
@@ -38,27 +45,79 @@ func (db *Database) SetAuth(containerID string, auth Auth) error {
 			return err
 		}
 	}
+	if auth.AuthorizedKeys != nil {
+		_, err := db.Exec("INSERT INTO auth (container_id, authorized_keys) VALUES ($1, $2) ON CONFLICT (container_id) DO UPDATE SET authorized_keys=$2", containerID, *auth.AuthorizedKeys)
+		if err != nil {
+			return err
+		}
+	}
+	if auth.TOTPSecret != nil {
+		_, err := db.Exec("INSERT INTO auth (container_id, totp_secret) VALUES ($1, $2) ON CONFLICT (container_id) DO UPDATE SET totp_secret=$2", containerID, *auth.TOTPSecret)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // GetAuthByContainer returns the auth by a container id
 func (db *Database) GetAuthByContainer(containerID string) (auth Auth, exists bool) {
-	if err := db.QueryRow("SELECT user, password FROM auth WHERE container_id=$1", containerID).Scan(&auth.User, &auth.Password); err != nil {
+	if err := db.QueryRow("SELECT user, password, authorized_keys, totp_secret FROM auth WHERE container_id=$1", containerID).Scan(&auth.User, &auth.Password, &auth.AuthorizedKeys, &auth.TOTPSecret); err != nil {
 		return Auth{}, false
 	}
 	return auth, true
 }
 
-func (db *Database) GetContainerByAuth(auth Auth) (containerID string, exists bool) {
-	// return true if `auth` contains a nil pointer or no auth was found in the database.
-	// hopefully this is no security issue
-	if auth.User == nil || auth.Password == nil {
-		return "", false
+// GetContainersByAuth returns all containers whose stored user and password
+// match the given ones
+func (db *Database) GetContainersByAuth(user string, password []byte) (containerIDs []string) {
+	rows, err := db.Query("SELECT container_id, password FROM auth WHERE user=$1 AND password IS NOT NULL", user)
+	if err != nil {
+		return nil
 	}
-	if err := db.QueryRow("SELECT container_id FROM auth WHERE user=$1 AND password=$2 OR password IS NULL", auth.User, auth.Password).Scan(&containerID); err != nil {
-		return "", false
+	defer rows.Close()
+
+	for rows.Next() {
+		var containerID string
+		var hash []byte
+		if err = rows.Scan(&containerID, &hash); err != nil {
+			return nil
+		}
+		if bcrypt.CompareHashAndPassword(hash, password) == nil {
+			containerIDs = append(containerIDs, containerID)
+		}
+	}
+	return containerIDs
+}
+
+// GetContainersByPublicKey returns all containers whose stored authorized
+// keys for the given user contain key
+func (db *Database) GetContainersByPublicKey(user string, key ssh.PublicKey) (containerIDs []string) {
+	rows, err := db.Query("SELECT container_id, authorized_keys FROM auth WHERE user=$1 AND authorized_keys IS NOT NULL", user)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var containerID, authorizedKeys string
+		if err = rows.Scan(&containerID, &authorizedKeys); err != nil {
+			return nil
+		}
+
+		rest := []byte(authorizedKeys)
+		for len(bytes.TrimSpace(rest)) > 0 {
+			var authorizedKey ssh.PublicKey
+			if authorizedKey, _, _, rest, err = ssh.ParseAuthorizedKey(rest); err != nil {
+				break
+			}
+			if bytes.Equal(authorizedKey.Marshal(), key.Marshal()) {
+				containerIDs = append(containerIDs, containerID)
+				break
+			}
+		}
 	}
-	return containerID, true
+	return containerIDs
 }
 
 func (db *Database) DeleteAuth(containerID string) error {
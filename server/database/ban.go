@@ -0,0 +1,67 @@
+package database
+
+import (
+	"time"
+)
+
+// Ban is an ip address which is not allowed to connect until the ban expires
+type Ban struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+func (db *Database) SetBan(ban Ban) error {
+	_, err := db.Exec("INSERT INTO bans (ip, until, reason) VALUES ($1, $2, $3) ON CONFLICT (ip) DO UPDATE SET until=$2, reason=$3", ban.IP, ban.Until.Unix(), ban.Reason)
+	return err
+}
+
+// GetBan returns the ban of the ip if it exists and has not expired yet
+func (db *Database) GetBan(ip string) (ban Ban, exists bool) {
+	var until int64
+	if err := db.QueryRow("SELECT ip, until, reason FROM bans WHERE ip=$1 AND until>$2", ip, time.Now().Unix()).Scan(&ban.IP, &until, &ban.Reason); err != nil {
+		return Ban{}, false
+	}
+	ban.Until = time.Unix(until, 0)
+	return ban, true
+}
+
+// GetBans returns all bans which have not expired yet
+func (db *Database) GetBans() ([]Ban, error) {
+	rows, err := db.Query("SELECT ip, until, reason FROM bans WHERE until>$1 ORDER BY until", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var ban Ban
+		var until int64
+		if err = rows.Scan(&ban.IP, &until, &ban.Reason); err != nil {
+			return nil, err
+		}
+		ban.Until = time.Unix(until, 0)
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// DeleteBan deletes the ban of the ip. Returns false if the ip was not banned
+func (db *Database) DeleteBan(ip string) (bool, error) {
+	result, err := db.Exec("DELETE FROM bans WHERE ip=$1", ip)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteBans deletes all bans and returns how many were deleted
+func (db *Database) DeleteBans() (int64, error) {
+	result, err := db.Exec("DELETE FROM bans")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -22,7 +23,15 @@ func newDatabaseConnection(driverName, dataSource string) (*Database, error) {
 }
 
 func NewSqlite3Connection(databaseFile string) (*Database, error) {
-	return newDatabaseConnection("sqlite3", databaseFile)
+	db, err := newDatabaseConnection("sqlite3", databaseFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %v", err)
+	}
+	return db, nil
 }
 
 func GetDatabase() *Database {
@@ -1,8 +1,10 @@
 create table if not exists auth
 (
-    container_id text not null,
-    user         text,
-    password     blob
+    container_id    text not null,
+    user            text,
+    password        blob,
+    authorized_keys text,
+    totp_secret     text
 );
 
 create unique index if not exists auth_container_id_uindex
@@ -26,3 +28,22 @@ create table if not exists settings
 
 create unique index if not exists settings_container_id_uindex
     on settings (container_id);
+
+create table if not exists bans
+(
+    ip     text not null,
+    until  integer not null,
+    reason text default '' not null
+);
+
+create unique index if not exists bans_ip_uindex
+    on bans (ip);
+
+create table if not exists logins
+(
+    container_id text not null,
+    last_login   integer not null
+);
+
+create unique index if not exists logins_container_id_uindex
+    on logins (container_id);
@@ -0,0 +1,21 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetLastLogin stores the time of the last login into a container
+func (db *Database) SetLastLogin(containerID string, at time.Time) error {
+	_, err := db.Exec("INSERT INTO logins (container_id, last_login) VALUES ($1, $2) ON CONFLICT (container_id) DO UPDATE SET last_login=$2", containerID, at.Unix())
+	return err
+}
+
+// GetLastLogin returns the time of the last login into a container
+func (db *Database) GetLastLogin(containerID string) (at time.Time, exists bool) {
+	var lastLogin int64
+	if err := db.QueryRow("SELECT last_login FROM logins WHERE container_id LIKE $1", fmt.Sprintf("%s%%", containerID)).Scan(&lastLogin); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(lastLogin, 0), true
+}
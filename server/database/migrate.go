@@ -0,0 +1,66 @@
+package database
+
+import (
+	_ "embed"
+	"fmt"
+)
+
+// schema creates all tables and indices which do not exist yet. It is also
+// used to create a new database file on installation
+//
+//go:embed database.sql
+var schema string
+
+// columnMigrations are columns which were added to existing tables after the
+// first release. Their definitions must match the ones in the schema
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"auth", "authorized_keys", "text"},
+	{"auth", "totp_secret", "text"},
+}
+
+// migrate updates databases which were created with an older schema. It is
+// idempotent, so it runs every time a connection is opened
+func (db *Database) migrate() error {
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	for _, migration := range columnMigrations {
+		columns, err := db.columns(migration.table)
+		if err != nil {
+			return err
+		}
+		if columns[migration.column] {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", migration.table, migration.column, migration.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s to %s: %v", migration.column, migration.table, err)
+		}
+	}
+	return nil
+}
+
+// columns returns the column names of table
+func (db *Database) columns(table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue interface{}
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
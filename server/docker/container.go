@@ -4,23 +4,31 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/rand"
 	c "docker4ssh/config"
 	"docker4ssh/database"
 	"docker4ssh/terminal"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"go.uber.org/zap"
 	"io"
 	"io/fs"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -40,6 +48,20 @@ func simpleContainerFromID(ctx context.Context, client *Client, config Config, c
 		client:          client,
 		cli:             client.Client,
 	}
+	for _, mount := range inspect.Mounts {
+		if mount.Destination == ContainerSocketDir {
+			sc.socketDir = mount.Source
+		}
+	}
+	// a running container is not started again, so its network information
+	// must be taken from the inspection
+	if inspect.NetworkSettings != nil {
+		if endpoint, ok := inspect.NetworkSettings.Networks[config.NetworkMode.NetworkName()]; ok && endpoint != nil {
+			sc.Network.ID = endpoint.NetworkID
+			sc.Network.IP = endpoint.IPAddress
+			sc.Network.Gateway = endpoint.Gateway
+		}
+	}
 
 	sc.init(ctx)
 
@@ -49,6 +71,21 @@ func simpleContainerFromID(ctx context.Context, client *Client, config Config, c
 // newSimpleContainer creates a new container.
 // Currently, only for internal usage, may be changing in future
 func newSimpleContainer(ctx context.Context, client *Client, config Config, image Image, containerName string) (*SimpleContainer, error) {
+	// the socket directory is shared with the container to provide sockets like the ssh agent
+	var hostConfig *container.HostConfig
+	var socketDir string
+	if cconfig := c.GetConfig(); cconfig.SSH.SocketDir != "" {
+		socketDir = filepath.Join(cconfig.SSH.SocketDir, containerName)
+		// the directory must be traversable by the container user, but the
+		// sockets in it are private
+		if err := os.MkdirAll(socketDir, 0711); err != nil {
+			return nil, err
+		}
+		hostConfig = &container.HostConfig{
+			Binds: []string{fmt.Sprintf("%s:%s", socketDir, ContainerSocketDir)},
+		}
+	}
+
 	// create a new container from the given image and activate in- and output
 	resp, err := client.Client.ContainerCreate(ctx, &container.Config{
 		Image:        image.Ref(),
@@ -57,7 +94,7 @@ func newSimpleContainer(ctx context.Context, client *Client, config Config, imag
 		Tty:          true,
 		AttachStdout: true,
 		OpenStdin:    true,
-	}, nil, nil, nil, containerName)
+	}, hostConfig, nil, nil, containerName)
 	if err != nil {
 		return nil, err
 	}
@@ -67,6 +104,7 @@ func newSimpleContainer(ctx context.Context, client *Client, config Config, imag
 		Image:           image,
 		ContainerID:     resp.ID[:12],
 		FullContainerID: resp.ID,
+		socketDir:       socketDir,
 		client:          client,
 		cli:             client.Client,
 	}
@@ -76,6 +114,10 @@ func newSimpleContainer(ctx context.Context, client *Client, config Config, imag
 	return sc, nil
 }
 
+// ContainerSocketDir is the directory inside the container where the socket
+// directory of the host is mounted to
+const ContainerSocketDir = "/run/docker4ssh"
+
 // SimpleContainer is the basic struct to control a docker4ssh container
 type SimpleContainer struct {
 	config          Config
@@ -83,6 +125,10 @@ type SimpleContainer struct {
 	ContainerID     string
 	FullContainerID string
 
+	// socketDir is the host directory which is mounted to ContainerSocketDir.
+	// Empty if the container has no socket directory
+	socketDir string
+
 	started bool
 
 	cancel context.CancelFunc
@@ -93,8 +139,9 @@ type SimpleContainer struct {
 	cli *client.Client
 
 	Network struct {
-		ID string
-		IP string
+		ID      string
+		IP      string
+		Gateway string
 	}
 }
 
@@ -139,6 +186,11 @@ func (sc *SimpleContainer) Stop(ctx context.Context) error {
 		if err := sc.cli.ContainerRemove(ctx, sc.FullContainerID, types.ContainerRemoveOptions{Force: true}); err != nil {
 			return err
 		}
+		if sc.socketDir != "" {
+			if err := os.RemoveAll(sc.socketDir); err != nil {
+				zap.S().Warnf("Failed to remove socket directory %s of %s: %v", sc.socketDir, sc.ContainerID, err)
+			}
+		}
 		// delete all references to the container in the database
 		return sc.client.Database.Delete(sc.FullContainerID)
 	}
@@ -192,9 +244,42 @@ func (sc *SimpleContainer) Execute(ctx context.Context, command string, args ...
 	return buf.Bytes(), nil
 }
 
-// CopyFrom copies a file from the host system to the client.
-// Normal files and directories are accepted
-func (sc *SimpleContainer) CopyFrom(ctx context.Context, src, dst string) error {
+// UserIDs returns the user and group id of the container user
+func (sc *SimpleContainer) UserIDs(ctx context.Context) (uid, gid int, err error) {
+	conn, err := sc.ExecuteConn(ctx, "sh", "-c", "id -u && id -g")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	// the output is multiplexed since no tty is attached
+	var stdout bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, io.Discard, conn); err != nil {
+		return 0, 0, err
+	}
+
+	ids := strings.Fields(stdout.String())
+	if len(ids) != 2 {
+		return 0, 0, fmt.Errorf("failed to get user and group id of the container user")
+	}
+	if uid, err = strconv.Atoi(ids[0]); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(ids[1]); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// StatPath returns information about a path inside the container
+func (sc *SimpleContainer) StatPath(ctx context.Context, path string) (types.ContainerPathStat, error) {
+	return sc.cli.ContainerStatPath(ctx, sc.FullContainerID, path)
+}
+
+// CopyTarFrom streams a file or directory from the container as tar archive.
+// read gets called for every entry of the archive, the entry names are
+// relative to the parent directory of src
+func (sc *SimpleContainer) CopyTarFrom(ctx context.Context, src string, read func(header *tar.Header, r io.Reader) error) error {
 	r, _, err := sc.cli.CopyFromContainer(ctx, sc.FullContainerID, src)
 	if err != nil {
 		return err
@@ -210,7 +295,43 @@ func (sc *SimpleContainer) CopyFrom(ctx context.Context, src, dst string) error
 			}
 			return err
 		}
+		if err = read(header, tr); err != nil {
+			return err
+		}
+	}
+}
 
+// CopyTarTo streams a tar archive, which is written by write, into the dst
+// directory of the container
+func (sc *SimpleContainer) CopyTarTo(ctx context.Context, dst string, options types.CopyToContainerOptions, write func(tw *tar.Writer) error) error {
+	pr, pw := io.Pipe()
+
+	errChan := make(chan error, 1)
+	go func() {
+		err := sc.cli.CopyToContainer(ctx, sc.FullContainerID, dst, pr, options)
+		// unblocks the writer if the copy has failed before the archive was fully read
+		pr.CloseWithError(err)
+		errChan <- err
+	}()
+
+	tw := tar.NewWriter(pw)
+	err := write(tw)
+	if err == nil {
+		err = tw.Close()
+	}
+	pw.CloseWithError(err)
+
+	copyErr := <-errChan
+	if err != nil {
+		return err
+	}
+	return copyErr
+}
+
+// CopyFrom copies a file from the container to the host.
+// Normal files and directories are accepted
+func (sc *SimpleContainer) CopyFrom(ctx context.Context, src, dst string) error {
+	return sc.CopyTarFrom(ctx, src, func(header *tar.Header, r io.Reader) error {
 		target := filepath.Join(dst, header.Name)
 
 		switch header.Typeflag {
@@ -225,16 +346,17 @@ func (sc *SimpleContainer) CopyFrom(ctx context.Context, src, dst string) error
 			if err != nil {
 				return err
 			}
+			defer f.Close()
 
-			if _, err = io.Copy(f, tr); err != nil {
+			if _, err = io.Copy(f, r); err != nil {
 				return err
 			}
-			_ = f.Close()
 		}
-	}
+		return nil
+	})
 }
 
-// CopyTo copies a file from the container to host.
+// CopyTo copies a file from the host to the container.
 // Normal files and directories are accepted
 func (sc *SimpleContainer) CopyTo(ctx context.Context, src, dst string) error {
 	stat, err := os.Stat(src)
@@ -242,82 +364,69 @@ func (sc *SimpleContainer) CopyTo(ctx context.Context, src, dst string) error {
 		return err
 	}
 
-	if stat.IsDir() {
-		err = filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
+	return sc.CopyTarTo(ctx, dst, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: true,
+	}, func(tw *tar.Writer) error {
+		if !stat.IsDir() {
+			return writeTarFile(tw, src, filepath.Base(src))
+		}
 
-			header, err := tar.FileInfoHeader(info, info.Name())
+		return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			header.Name = strings.TrimPrefix(strings.TrimPrefix(path, src), "/")
-
-			// write every file to the container.
-			// it might be better to write the file content to a buffer or
-			// store the file pointer in a slice and write the buffer / stored
-			// file pointer to the tar writer when every file was walked
-			//
-			// TODO: Test if the two described methods are better than sending every file on it's own
-			buf := &bytes.Buffer{}
-
-			tw := tar.NewWriter(buf)
-			if err = tw.WriteHeader(header); err != nil {
-				return err
-			}
-			defer tw.Close()
-
-			io.Copy(tw, file)
-
-			err = sc.cli.CopyToContainer(ctx, sc.FullContainerID, dst, buf, types.CopyToContainerOptions{
-				AllowOverwriteDirWithFile: true,
-			})
-			if err != nil {
-				return err
+			name := strings.TrimPrefix(strings.TrimPrefix(path, src), "/")
+			if name == "" {
+				// the directory itself
+				return nil
 			}
-			return nil
+			return writeTarFile(tw, path, name)
 		})
-		if err != nil {
-			return err
-		}
-	} else {
-		file, err := os.Open(src)
-		if err != nil {
-			return err
-		}
-		info, err := os.Lstat(src)
-		if err != nil {
-			return err
-		}
-		header, err := tar.FileInfoHeader(info, info.Name())
-		if err != nil {
-			return err
-		}
-		header.Name = filepath.Base(src)
+	})
+}
 
-		buf := &bytes.Buffer{}
-		tw := tar.NewWriter(buf)
-		if err = tw.WriteHeader(header); err != nil {
+// writeTarFile writes the file or directory at path as name to the tar writer
+func writeTarFile(tw *tar.Writer, path, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
 			return err
 		}
-		defer tw.Close()
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
 
-		_, _ = io.Copy(tw, file)
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
 
-		err = sc.cli.CopyToContainer(ctx, sc.FullContainerID, dst, buf, types.CopyToContainerOptions{
-			AllowOverwriteDirWithFile: true,
-		})
-		if err != nil {
-			return err
-		}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	return nil
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// SocketPath returns the host and container path of a new socket with the
+// given name. ok is false if the container has no socket directory
+func (sc *SimpleContainer) SocketPath(name string) (hostPath, containerPath string, ok bool) {
+	if sc.socketDir == "" {
+		return "", "", false
+	}
+	return filepath.Join(sc.socketDir, name), path.Join(ContainerSocketDir, name), true
 }
 
 // Config returns the current container config
@@ -428,7 +537,10 @@ func (sc *SimpleContainer) setNetworkMode(ctx context.Context, oldMode, newMode
 	}
 	// update the internal network information
 	sc.Network.ID = networkID
-	sc.Network.IP = resp.NetworkSettings.Networks[newMode.NetworkName()].IPAddress
+	if endpoint, ok := resp.NetworkSettings.Networks[newMode.NetworkName()]; ok && endpoint != nil {
+		sc.Network.IP = endpoint.IPAddress
+		sc.Network.Gateway = endpoint.Gateway
+	}
 
 	return nil
 }
@@ -476,6 +588,83 @@ func (sc *SimpleContainer) setConfigurable(ctx context.Context, configurable boo
 	return nil
 }
 
+// sftpServerPaths are the locations where the sftp server binary is
+// installed by the most common linux distributions
+var sftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/libexec/sftp-server",
+	"/usr/lib/sftp-server",
+}
+
+// SFTPCommand returns the command which starts a sftp server inside the container
+// and a function which removes everything the server needed after it has ended.
+// If a sftp server binary is configured, it gets copied into the container for
+// the session and is only executable by the container user. Otherwise, the sftp
+// server of the image is used if existing
+func (ic *InteractiveContainer) SFTPCommand(ctx context.Context) (string, func(), error) {
+	cconfig := c.GetConfig()
+
+	if cconfig.SSH.SFTP.Binary == "" {
+		// the binary is started via exec to not have a shell process between
+		// the sftp server and the client which could alter the output
+		script := &strings.Builder{}
+		for _, path := range sftpServerPaths {
+			fmt.Fprintf(script, "[ -x %[1]s ] && exec %[1]s; ", path)
+		}
+		script.WriteString("echo 'no sftp server found' >&2; exit 127")
+		return script.String(), func() {}, nil
+	}
+
+	uid, gid, err := ic.UserIDs(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	binary, err := os.Open(cconfig.SSH.SFTP.Binary)
+	if err != nil {
+		return "", nil, err
+	}
+	defer binary.Close()
+	stat, err := binary.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	rawName := make([]byte, 8)
+	if _, err = rand.Read(rawName); err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf(".docker4ssh-sftp-%s", hex.EncodeToString(rawName))
+
+	err = ic.CopyTarTo(ctx, "/tmp", types.CopyToContainerOptions{CopyUIDGID: true}, func(tw *tar.Writer) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0700,
+			Uid:     uid,
+			Gid:     gid,
+			Size:    stat.Size(),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, binary)
+		return err
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to copy %s into %s: %v", cconfig.SSH.SFTP.Binary, ic.ContainerID, err)
+	}
+	containerPath := path.Join("/tmp", name)
+	zap.S().Debugf("Copied %s to %s (%s)", cconfig.SSH.SFTP.Binary, containerPath, ic.ContainerID)
+
+	return fmt.Sprintf("exec %s", containerPath), func() {
+		// the session context is already done when the server has ended
+		if err := ic.RemoveFile(context.Background(), containerPath); err != nil {
+			zap.S().Warnf("Failed to remove %s from %s: %v", containerPath, ic.ContainerID, err)
+		}
+	}, nil
+}
+
 // setAPIRoute sets the IP and port for docker container tools
 func (sc *SimpleContainer) setAPIRoute(ctx context.Context, activate bool) error {
 	var err error
@@ -562,23 +751,188 @@ func NewInteractiveContainer(ctx context.Context, cli *Client, config Config, im
 	}, nil
 }
 
+// ExitStatus describes how a terminal process has finished
+type ExitStatus struct {
+	// Code is the exit code of the process
+	Code int
+
+	// Signal is the signal name (without 'SIG' prefix) which has killed the
+	// process. Empty if the process exited normally
+	Signal string
+}
+
+// signalNames contains all signals which can be reported via ssh (RFC 4254 section 6.10)
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+// execExitStatusFromCode returns the exit status of an exec process. Docker
+// reports processes which were killed by a signal with the exit code 128 +
+// signal number. The process is started by the shell of the container
+// directly, so the code is not made up by a wrapper of docker4ssh
+func execExitStatusFromCode(code int) *ExitStatus {
+	status := &ExitStatus{Code: code}
+	if code > 128 {
+		if name, ok := signalNames[syscall.Signal(code-128)]; ok {
+			status.Signal = name
+		}
+	}
+	return status
+}
+
 type InteractiveContainer struct {
 	*SimpleContainer
 
-	terminalCount int
+	// terminalCount is changed by the sessions of multiple connections, so
+	// it must only be accessed atomically
+	terminalCount int32
+
+	detachMutex sync.Mutex
+	detachables []*DetachableTerminal
+	// detachChanged gets closed and replaced every time a detachable
+	// terminal gets detached, attached or ends
+	detachChanged  chan struct{}
+	lastDetachable int
+
+	terminalsMutex sync.Mutex
+	terminals      []*terminal.Terminal
 }
 
-// TerminalCount returns the count of active terminals
+// Terminals returns all terminals which are currently served by the
+// container
+func (ic *InteractiveContainer) Terminals() []*terminal.Terminal {
+	ic.terminalsMutex.Lock()
+	defer ic.terminalsMutex.Unlock()
+
+	return append([]*terminal.Terminal{}, ic.terminals...)
+}
+
+// serveTerminal registers the terminal as served by the container. The
+// returned function unregisters it and ends all its shadows
+func (ic *InteractiveContainer) serveTerminal(term *terminal.Terminal) func() {
+	ic.terminalsMutex.Lock()
+	ic.terminals = append(ic.terminals, term)
+	ic.terminalsMutex.Unlock()
+
+	return func() {
+		ic.terminalsMutex.Lock()
+		for i, t := range ic.terminals {
+			if t == term {
+				ic.terminals = append(ic.terminals[:i], ic.terminals[i+1:]...)
+				break
+			}
+		}
+		ic.terminalsMutex.Unlock()
+		term.EndShadows()
+	}
+}
+
+// TerminalCount returns the count of active terminals, including detached ones
 func (ic *InteractiveContainer) TerminalCount() int {
-	return ic.terminalCount
+	return int(atomic.LoadInt32(&ic.terminalCount)) + len(ic.DetachedTerminals())
 }
 
-// Terminal creates a new interactive terminal session for the container
-func (ic *InteractiveContainer) Terminal(ctx context.Context, term *terminal.Terminal) error {
+// Terminal creates a new terminal session for the container.
+// If terminal.Terminal.Command is set, the command is executed instead of an interactive shell
+//
+// The returned ExitStatus is nil if the session has ended before the process,
+// e.g. because of a timeout. If the client has closed the session, the
+// process is killed
+//
+// If terminal.Terminal.Detachable is set and an interactive shell with a pty
+// is requested, the shell keeps running when the client disconnects and can
+// be reattached via Reattach
+func (ic *InteractiveContainer) Terminal(ctx context.Context, term *terminal.Terminal) (*ExitStatus, error) {
+	execID, resp, err := ic.startExec(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+
+	if term.Detachable && term.Pty && term.Command == "" {
+		return ic.attach(ctx, ic.newDetachableTerminal(execID, resp, term.DetachTimeout), term)
+	}
+
+	if term.Pty {
+		// the exec must be started (which is done by attaching to it) before it can be resized
+		term.OnResize(ic.execResizer(ctx, execID))
+		defer term.OnResize(nil)
+	}
+
+	input := term.RecordInput(resp.Conn)
+	term.SetInput(input)
+	defer ic.serveTerminal(term)()
+
+	errChan := make(chan error, 2)
+
+	go func() {
+		// copy every output from the container. if no tty is attached, stdout
+		// and stderr are multiplexed and must be separated
+		var err error
+		if term.Pty {
+			_, err = io.Copy(term.RecordWriter(term.ShadowWriter(term.ActivityWriter(term))), resp.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(term.ShadowWriter(term.ActivityWriter(term)), term.ShadowWriter(term.ActivityWriter(term.ErrorWriter())), resp.Reader)
+		}
+		errChan <- err
+	}()
+	go func() {
+		// copy every input to the container
+		_, err := io.Copy(input, term.ActivityReader(term))
+		if term.Pty {
+			errChan <- err
+		} else {
+			// without a tty the input may end before the command has finished
+			// (e.g. 'echo test | ssh ... cat'), so only the input stream gets
+			// closed and the output is read until the command exits
+			resp.CloseWrite()
+		}
+	}()
+
+	atomic.AddInt32(&ic.terminalCount, 1)
+	select {
+	case err = <-errChan:
+		resp.Close()
+	case <-ctx.Done():
+		// the session was ended by the server, e.g. because of a timeout.
+		// the process may still be running, so its exit status is unknown
+		resp.Close()
+		atomic.AddInt32(&ic.terminalCount, -1)
+		return nil, nil
+	case <-term.Closed:
+		// the client is gone. without a tty the process does not notice
+		// it and would run forever, so it gets killed
+		resp.Close()
+		ic.killExec(ctx, execID)
+		atomic.AddInt32(&ic.terminalCount, -1)
+		return nil, nil
+	}
+	atomic.AddInt32(&ic.terminalCount, -1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ic.execExitStatus(ctx, execID)
+}
+
+// startExec creates and attaches to the exec which serves the terminal
+func (ic *InteractiveContainer) startExec(ctx context.Context, term *terminal.Terminal) (string, types.HijackedResponse, error) {
 	// get the default shell for the root user
 	rawShell, err := ic.Execute(ctx, "sh", "-c", "getent passwd root | cut -d : -f 7")
 	if err != nil {
-		return err
+		return "", types.HijackedResponse{}, err
 	}
 
 	// here we cut out only newlines (which also could've been done via
@@ -592,46 +946,76 @@ func (ic *InteractiveContainer) Terminal(ctx context.Context, term *terminal.Ter
 		}
 	}
 
+	cmd := []string{shell.String()}
+	if term.Command != "" {
+		cmd = append(cmd, "-c", term.Command)
+	}
+	env := append([]string{}, term.Env...)
+	if term.Pty && term.Term != "" {
+		env = append(env, fmt.Sprintf("TERM=%s", term.Term))
+	}
+
 	id, err := ic.cli.ContainerExecCreate(ctx, ic.FullContainerID, types.ExecConfig{
-		Tty:          true,
+		Tty:          term.Pty,
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
-		Cmd:          []string{shell.String()},
+		Env:          env,
+		Cmd:          cmd,
 	})
 	if err != nil {
-		return err
+		return "", types.HijackedResponse{}, err
 	}
 
 	resp, err := ic.cli.ContainerExecAttach(ctx, id.ID, types.ExecStartCheck{
-		Tty: true,
+		Tty: term.Pty,
 	})
 	if err != nil {
-		return err
+		return "", types.HijackedResponse{}, err
 	}
-	errChan := make(chan error)
+	return id.ID, resp, nil
+}
 
-	go func() {
-		// copy every input to the container
-		if _, err = io.Copy(term, resp.Conn); err != nil {
-			errChan <- err
+// execResizer returns a resize handler which resizes the tty of the exec
+func (ic *InteractiveContainer) execResizer(ctx context.Context, execID string) func(width, height uint32) {
+	return func(width, height uint32) {
+		if err := ic.cli.ContainerExecResize(ctx, execID, types.ResizeOptions{
+			Height: uint(height),
+			Width:  uint(width),
+		}); err != nil {
+			zap.S().Warnf("Failed to resize terminal of %s: %v", ic.ContainerID, err)
 		}
-		errChan <- nil
-	}()
-	go func() {
-		// copy every output from the container
-		if _, err = io.Copy(resp.Conn, term); err != nil {
-			errChan <- err
-		}
-		errChan <- nil
-	}()
+	}
+}
 
-	ic.terminalCount++
-	select {
-	case err = <-errChan:
-		resp.Conn.Close()
+// killExec kills the process of the exec if it is still running. Docker has no
+// api for this, so the process is killed via its pid on the host
+func (ic *InteractiveContainer) killExec(ctx context.Context, execID string) {
+	inspect, err := ic.cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		zap.S().Warnf("Failed to inspect exec of %s: %v", ic.ContainerID, err)
+		return
+	}
+	if !inspect.Running || inspect.Pid <= 0 {
+		return
+	}
+	if err = syscall.Kill(inspect.Pid, syscall.SIGKILL); err != nil {
+		zap.S().Warnf("Failed to kill exec process %d of %s: %v", inspect.Pid, ic.ContainerID, err)
 	}
-	ic.terminalCount--
+}
 
-	return err
+// execExitStatus waits shortly until the exec process has finished and returns its exit status
+func (ic *InteractiveContainer) execExitStatus(ctx context.Context, execID string) (*ExitStatus, error) {
+	// the exec may still be marked as running directly after its output stream has closed
+	for i := 0; i < 10; i++ {
+		inspect, err := ic.cli.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return nil, err
+		}
+		if !inspect.Running {
+			return execExitStatusFromCode(inspect.ExitCode), nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, nil
 }
@@ -0,0 +1,250 @@
+package docker
+
+import (
+	"context"
+	"docker4ssh/terminal"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// detachBufferSize is the size of the recent output of a detachable terminal
+// which is replayed when it gets reattached
+const detachBufferSize = 64 * 1024
+
+// ErrTerminalAttached is returned by Reattach if another client is attached
+// to the terminal
+var ErrTerminalAttached = errors.New("terminal is attached to another client")
+
+// DetachableTerminal is an interactive shell which outlives the ssh session it
+// was started by. While no client is attached, its output is only buffered
+type DetachableTerminal struct {
+	ID      int
+	Started time.Time
+
+	container *InteractiveContainer
+	execID    string
+	resp      types.HijackedResponse
+	timeout   time.Duration
+
+	mutex  sync.Mutex
+	buffer []byte
+	output io.Writer
+	// attachment is increased on every attach
+	attachment int
+	attached   bool
+	detachedAt time.Time
+	expire     *time.Timer
+
+	done chan struct{}
+}
+
+func (ic *InteractiveContainer) newDetachableTerminal(execID string, resp types.HijackedResponse, timeout time.Duration) *DetachableTerminal {
+	ic.detachMutex.Lock()
+	ic.lastDetachable++
+	dt := &DetachableTerminal{
+		ID:        ic.lastDetachable,
+		Started:   time.Now(),
+		container: ic,
+		execID:    execID,
+		resp:      resp,
+		timeout:   timeout,
+		done:      make(chan struct{}),
+	}
+	ic.detachables = append(ic.detachables, dt)
+	ic.detachMutex.Unlock()
+
+	go func() {
+		// the output is read for the whole lifetime of the shell, not only
+		// while a client is attached
+		io.Copy(dt, resp.Reader)
+		resp.Close()
+		close(dt.done)
+
+		dt.mutex.Lock()
+		if dt.expire != nil {
+			dt.expire.Stop()
+		}
+		dt.mutex.Unlock()
+
+		ic.detachMutex.Lock()
+		for i, detachable := range ic.detachables {
+			if detachable == dt {
+				ic.detachables = append(ic.detachables[:i], ic.detachables[i+1:]...)
+				break
+			}
+		}
+		ic.detachMutex.Unlock()
+		ic.notifyDetachChanged()
+	}()
+
+	return dt
+}
+
+// Write buffers the output of the shell and passes it to the attached client
+func (dt *DetachableTerminal) Write(p []byte) (int, error) {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	dt.buffer = append(dt.buffer, p...)
+	if len(dt.buffer) > detachBufferSize {
+		dt.buffer = append([]byte{}, dt.buffer[len(dt.buffer)-detachBufferSize:]...)
+	}
+	if dt.output != nil {
+		if _, err := dt.output.Write(p); err != nil {
+			// the client is gone, the input copy notices it too and detaches
+			dt.output = nil
+		}
+	}
+	return len(p), nil
+}
+
+// Detached returns when the terminal was detached. ok is false if a client is
+// attached to it
+func (dt *DetachableTerminal) Detached() (detachedAt time.Time, ok bool) {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	return dt.detachedAt, !dt.attached
+}
+
+// Close ends the shell
+func (dt *DetachableTerminal) Close() error {
+	return dt.resp.Conn.Close()
+}
+
+// DetachableTerminals returns all detachable terminals of the container,
+// attached and detached ones
+func (ic *InteractiveContainer) DetachableTerminals() []*DetachableTerminal {
+	ic.detachMutex.Lock()
+	defer ic.detachMutex.Unlock()
+
+	return append([]*DetachableTerminal{}, ic.detachables...)
+}
+
+// DetachedTerminals returns all detachable terminals of the container which
+// have no client attached
+func (ic *InteractiveContainer) DetachedTerminals() []*DetachableTerminal {
+	var detached []*DetachableTerminal
+	for _, dt := range ic.DetachableTerminals() {
+		if _, ok := dt.Detached(); ok {
+			detached = append(detached, dt)
+		}
+	}
+	return detached
+}
+
+// WaitDetached blocks until the container has no detached terminals anymore,
+// either because they were reattached or because they have ended
+func (ic *InteractiveContainer) WaitDetached() {
+	for {
+		ic.detachMutex.Lock()
+		if ic.detachChanged == nil {
+			ic.detachChanged = make(chan struct{})
+		}
+		changed := ic.detachChanged
+		ic.detachMutex.Unlock()
+
+		if len(ic.DetachedTerminals()) == 0 {
+			return
+		}
+		<-changed
+	}
+}
+
+func (ic *InteractiveContainer) notifyDetachChanged() {
+	ic.detachMutex.Lock()
+	defer ic.detachMutex.Unlock()
+
+	if ic.detachChanged != nil {
+		close(ic.detachChanged)
+		ic.detachChanged = nil
+	}
+}
+
+// Reattach attaches the terminal to the detached terminal. The recent output
+// of the shell is replayed first. If another client is attached to it,
+// ErrTerminalAttached is returned
+func (ic *InteractiveContainer) Reattach(ctx context.Context, dt *DetachableTerminal, term *terminal.Terminal) (*ExitStatus, error) {
+	return ic.attach(ctx, dt, term)
+}
+
+// attach serves the detachable terminal to term until the shell ends, the
+// client disconnects (the shell gets detached) or ctx is done (the shell gets
+// closed)
+func (ic *InteractiveContainer) attach(ctx context.Context, dt *DetachableTerminal, term *terminal.Terminal) (*ExitStatus, error) {
+	dt.mutex.Lock()
+	if dt.attached {
+		// a terminal is never taken over from another client
+		dt.mutex.Unlock()
+		return nil, ErrTerminalAttached
+	}
+	if dt.expire != nil {
+		dt.expire.Stop()
+		dt.expire = nil
+	}
+	dt.attachment++
+	attachment := dt.attachment
+	if attachment > 1 {
+		// clear the screen before the recent output gets replayed. the replay
+		// is recorded so that the recording of the session has its context
+		replay := term.RecordWriter(term)
+		replay.Write([]byte("\x1bc"))
+		replay.Write(dt.buffer)
+	}
+	dt.output = term.RecordWriter(term.ShadowWriter(term.ActivityWriter(term)))
+	dt.attached = true
+	atomic.AddInt32(&ic.terminalCount, 1)
+	dt.mutex.Unlock()
+	ic.notifyDetachChanged()
+
+	// the size of the new client may differ from the previous one
+	term.OnResize(ic.execResizer(ctx, dt.execID))
+	defer term.OnResize(nil)
+
+	input := term.RecordInput(dt.resp.Conn)
+	term.SetInput(input)
+	defer ic.serveTerminal(term)()
+
+	inputDone := make(chan struct{})
+	go func() {
+		io.Copy(input, term.ActivityReader(term))
+		close(inputDone)
+	}()
+
+	select {
+	case <-dt.done:
+		atomic.AddInt32(&ic.terminalCount, -1)
+		return ic.execExitStatus(ctx, dt.execID)
+	case <-ctx.Done():
+		// the session was ended by the server, e.g. because of a timeout, so
+		// the shell is closed instead of detached
+		dt.Close()
+		atomic.AddInt32(&ic.terminalCount, -1)
+		return nil, nil
+	case <-inputDone:
+	}
+
+	dt.mutex.Lock()
+	if dt.attachment == attachment {
+		dt.output = nil
+		dt.attached = false
+		dt.detachedAt = time.Now()
+		if dt.timeout > 0 {
+			dt.expire = time.AfterFunc(dt.timeout, func() {
+				zap.S().Infof("Closing detached terminal %d of %s after %s", dt.ID, ic.ContainerID, dt.timeout)
+				dt.Close()
+			})
+		}
+		zap.S().Infof("Detached terminal %d of %s", dt.ID, ic.ContainerID)
+	}
+	atomic.AddInt32(&ic.terminalCount, -1)
+	dt.mutex.Unlock()
+	ic.notifyDetachChanged()
+
+	return nil, nil
+}
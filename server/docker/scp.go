@@ -0,0 +1,429 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"docker4ssh/terminal"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SCPOptions describes a legacy scp command ('scp -t' or 'scp -f') which a
+// client sends via exec
+type SCPOptions struct {
+	// Sink is true if the client uploads files (-t)
+	Sink bool
+	// Source is true if the client downloads files (-f)
+	Source bool
+
+	Recursive   bool
+	Preserve    bool
+	TargetIsDir bool
+
+	Paths []string
+}
+
+// ParseSCPCommand parses an exec command which was sent by a scp client.
+// ok is false if the command is no scp command in server mode
+func ParseSCPCommand(command string) (options SCPOptions, ok bool) {
+	args, err := splitShellWords(command)
+	if err != nil || len(args) == 0 || path.Base(args[0]) != "scp" {
+		return SCPOptions{}, false
+	}
+
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				options.Sink = true
+			case 'f':
+				options.Source = true
+			case 'r':
+				options.Recursive = true
+			case 'p':
+				options.Preserve = true
+			case 'd':
+				options.TargetIsDir = true
+			}
+			// other flags like -v or -q do not change the protocol and are ignored
+		}
+	}
+	options.Paths = args
+
+	if options.Sink == options.Source || len(options.Paths) == 0 || (options.Sink && len(options.Paths) != 1) {
+		return SCPOptions{}, false
+	}
+	return options, true
+}
+
+// SCP serves the legacy scp protocol. Files are streamed directly from and
+// to the container, so no scp binary must be installed in it
+func (ic *InteractiveContainer) SCP(ctx context.Context, term *terminal.Terminal, options SCPOptions) (*ExitStatus, error) {
+	atomic.AddInt32(&ic.terminalCount, 1)
+	defer func() {
+		atomic.AddInt32(&ic.terminalCount, -1)
+	}()
+
+	// like with a normal scp server, relative paths are relative to the home directory
+	for i, p := range options.Paths {
+		if !path.IsAbs(p) {
+			home, err := ic.homeDir(ctx)
+			if err != nil {
+				return nil, err
+			}
+			options.Paths[i] = path.Join(home, p)
+		}
+	}
+
+	r := bufio.NewReader(term)
+
+	var err error
+	if options.Sink {
+		err = ic.scpSink(ctx, term, r, options)
+	} else {
+		err = ic.scpSource(ctx, term, r, options)
+	}
+	if err != nil {
+		// the error is sent to the client which shows it to the user
+		fmt.Fprintf(term, "\x01scp: %v\n", err)
+		return &ExitStatus{Code: 1}, nil
+	}
+	return &ExitStatus{Code: 0}, nil
+}
+
+// homeDir returns the home directory of the container user
+func (ic *InteractiveContainer) homeDir(ctx context.Context) (string, error) {
+	conn, err := ic.ExecuteConn(ctx, "sh", "-c", "echo $HOME")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// the output is multiplexed since no tty is attached
+	var stdout bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, io.Discard, conn); err != nil {
+		return "", err
+	}
+
+	if home := strings.TrimSpace(stdout.String()); home != "" {
+		return home, nil
+	}
+	return "/", nil
+}
+
+// scpSink receives files from the client and writes them into the container
+func (ic *InteractiveContainer) scpSink(ctx context.Context, w io.Writer, r *bufio.Reader, options SCPOptions) error {
+	target := options.Paths[0]
+
+	// if the target is no existing directory, it is the new name of the
+	// transferred file or directory
+	baseDir, rename := target, ""
+	if stat, err := ic.StatPath(ctx, target); err != nil || !stat.Mode.IsDir() {
+		if options.TargetIsDir {
+			return fmt.Errorf("%s: Not a directory", target)
+		}
+		baseDir, rename = path.Dir(target), path.Base(target)
+	}
+
+	if _, err := w.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	return ic.CopyTarTo(ctx, baseDir, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: true,
+		// the files get the owner of the container user
+		CopyUIDGID: true,
+	}, func(tw *tar.Writer) error {
+		return scpReceive(w, r, tw, options, rename)
+	})
+}
+
+// scpReceive reads the files and directories the client sends and writes
+// them to tw. If rename is not empty, the first received entry gets this name
+func scpReceive(w io.Writer, r *bufio.Reader, tw *tar.Writer, options SCPOptions, rename string) error {
+	var dirs []string
+	var modTime time.Time
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("protocol error: empty message")
+		}
+
+		switch line[0] {
+		case 'T':
+			var mtime, atime int64
+			if _, err = fmt.Sscanf(line[1:], "%d 0 %d 0", &mtime, &atime); err != nil {
+				return fmt.Errorf("protocol error: mtime.sec not delimited")
+			}
+			modTime = time.Unix(mtime, 0)
+		case 'C', 'D':
+			mode, size, name, err := parseSCPEntry(line[1:])
+			if err != nil {
+				return err
+			}
+			if len(dirs) == 0 && rename != "" {
+				name = rename
+			}
+			if modTime.IsZero() {
+				modTime = time.Now()
+			}
+
+			header := &tar.Header{
+				Name:    path.Join(append(dirs, name)...),
+				Mode:    mode,
+				ModTime: modTime,
+			}
+			modTime = time.Time{}
+
+			if line[0] == 'D' {
+				if !options.Recursive {
+					return fmt.Errorf("received directory without -r")
+				}
+				header.Typeflag = tar.TypeDir
+				header.Name += "/"
+				if err = tw.WriteHeader(header); err != nil {
+					return err
+				}
+				dirs = append(dirs, name)
+			} else {
+				header.Typeflag = tar.TypeReg
+				header.Size = size
+				if err = tw.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err = w.Write([]byte{0}); err != nil {
+					return err
+				}
+				if _, err = io.CopyN(tw, r, size); err != nil {
+					return err
+				}
+				// the client confirms the end of the file content
+				if err = readSCPAck(r); err != nil {
+					return err
+				}
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("protocol error: unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case '\x01', '\x02':
+			// error message from the client
+			if line[0] == '\x02' {
+				return fmt.Errorf("%s", line[1:])
+			}
+			continue
+		default:
+			return fmt.Errorf("protocol error: unexpected message '%s'", line)
+		}
+
+		if _, err = w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+}
+
+// scpSource sends files from the container to the client
+func (ic *InteractiveContainer) scpSource(ctx context.Context, w io.Writer, r *bufio.Reader, options SCPOptions) error {
+	// the client signals that it is ready to receive
+	if err := readSCPAck(r); err != nil {
+		return err
+	}
+
+	for _, src := range options.Paths {
+		stat, err := ic.StatPath(ctx, src)
+		if err != nil {
+			return fmt.Errorf("%s: No such file or directory", src)
+		}
+		if stat.Mode.IsDir() && !options.Recursive {
+			return fmt.Errorf("%s: not a regular file", src)
+		}
+
+		// the archive entries have the name of the link target if src is a symlink
+		resolved := src
+		if stat.LinkTarget != "" {
+			resolved = stat.LinkTarget
+		}
+
+		var dirs []string
+		err = ic.CopyTarFrom(ctx, resolved, func(header *tar.Header, tr io.Reader) error {
+			parts := strings.Split(strings.TrimSuffix(header.Name, "/"), "/")
+			if parts[0] == path.Base(resolved) {
+				parts[0] = path.Base(src)
+			}
+			name, parents := parts[len(parts)-1], parts[:len(parts)-1]
+
+			// leave all directories which are not a parent of the current entry
+			var common int
+			for common < len(dirs) && common < len(parents) && dirs[common] == parents[common] {
+				common++
+			}
+			for len(dirs) > common {
+				if err := sendSCPMessage(w, r, "E\n"); err != nil {
+					return err
+				}
+				dirs = dirs[:len(dirs)-1]
+			}
+
+			if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg {
+				// symlinks and special files are skipped
+				return nil
+			}
+
+			if options.Preserve {
+				accessTime := header.AccessTime
+				if accessTime.IsZero() {
+					accessTime = header.ModTime
+				}
+				if err := sendSCPMessage(w, r, fmt.Sprintf("T%d 0 %d 0\n", header.ModTime.Unix(), accessTime.Unix())); err != nil {
+					return err
+				}
+			}
+
+			if header.Typeflag == tar.TypeDir {
+				if err := sendSCPMessage(w, r, fmt.Sprintf("D%04o 0 %s\n", header.Mode&07777, name)); err != nil {
+					return err
+				}
+				dirs = append(dirs, name)
+				return nil
+			}
+
+			if err := sendSCPMessage(w, r, fmt.Sprintf("C%04o %d %s\n", header.Mode&07777, header.Size, name)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, tr, header.Size); err != nil {
+				return err
+			}
+			return sendSCPMessage(w, r, "\x00")
+		})
+		if err != nil {
+			return err
+		}
+		for range dirs {
+			if err = sendSCPMessage(w, r, "E\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseSCPEntry parses the '<mode> <size> <name>' part of a 'C' or 'D' message
+func parseSCPEntry(entry string) (mode int64, size int64, name string, err error) {
+	split := strings.SplitN(entry, " ", 3)
+	if len(split) != 3 {
+		return 0, 0, "", fmt.Errorf("protocol error: invalid entry '%s'", entry)
+	}
+	if mode, err = strconv.ParseInt(split[0], 8, 64); err != nil || mode < 0 || mode > 07777 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad mode '%s'", split[0])
+	}
+	if size, err = strconv.ParseInt(split[1], 10, 64); err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("protocol error: size not delimited")
+	}
+	name = split[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("unexpected filename: %s", name)
+	}
+	return mode, size, name, nil
+}
+
+// sendSCPMessage sends a message to the client and waits for its acknowledgement
+func sendSCPMessage(w io.Writer, r *bufio.Reader, message string) error {
+	if _, err := io.WriteString(w, message); err != nil {
+		return err
+	}
+	return readSCPAck(r)
+}
+
+// readSCPAck reads the response of the client. A response is either a
+// single zero byte or a 1 (warning) or 2 (fatal) byte followed by an
+// error message
+func readSCPAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	message, _ := r.ReadString('\n')
+	return fmt.Errorf("%s", strings.TrimSuffix(message, "\n"))
+}
+
+// splitShellWords splits a command into its arguments like a posix shell
+// would do it, without expanding variables or globs
+func splitShellWords(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var inWord bool
+	var quote rune
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\':
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,284 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSCPEntry(t *testing.T) {
+	tests := []struct {
+		entry string
+		mode  int64
+		size  int64
+		name  string
+		ok    bool
+	}{
+		{"0644 12 file.txt", 0644, 12, "file.txt", true},
+		{"0755 0 dir", 0755, 0, "dir", true},
+		{"0644 3 name with spaces", 0644, 3, "name with spaces", true},
+		{"0644 3 ..hidden", 0644, 3, "..hidden", true},
+
+		// truncated headers
+		{"", 0, 0, "", false},
+		{"0644", 0, 0, "", false},
+		{"0644 12", 0, 0, "", false},
+		{"0644 12 ", 0, 0, "", false},
+
+		// bad modes
+		{"0899 12 file", 0, 0, "", false},
+		{"-644 12 file", 0, 0, "", false},
+		{"17777 12 file", 0, 0, "", false},
+		{"rw-r--r-- 12 file", 0, 0, "", false},
+
+		// bad sizes
+		{"0644 -1 file", 0, 0, "", false},
+		{"0644 1x file", 0, 0, "", false},
+		{"0644 99999999999999999999 file", 0, 0, "", false},
+
+		// names which would escape the target directory
+		{"0644 12 .", 0, 0, "", false},
+		{"0644 12 ..", 0, 0, "", false},
+		{"0644 12 ../file", 0, 0, "", false},
+		{"0644 12 dir/../../file", 0, 0, "", false},
+		{"0644 12 /etc/passwd", 0, 0, "", false},
+		{"0644 12 dir/", 0, 0, "", false},
+	}
+
+	for _, test := range tests {
+		mode, size, name, err := parseSCPEntry(test.entry)
+		if (err == nil) != test.ok {
+			t.Errorf("parseSCPEntry(%q): expected ok=%t, got error %v", test.entry, test.ok, err)
+			continue
+		}
+		if mode != test.mode || size != test.size || name != test.name {
+			t.Errorf("parseSCPEntry(%q) = %o, %d, %q, expected %o, %d, %q", test.entry, mode, size, name, test.mode, test.size, test.name)
+		}
+	}
+}
+
+func TestSCPReceive(t *testing.T) {
+	type entry struct {
+		name    string
+		mode    int64
+		content string
+	}
+
+	tests := []struct {
+		name      string
+		input     string
+		recursive bool
+		rename    string
+		entries   []entry
+		ok        bool
+	}{
+		{
+			name:    "single file",
+			input:   "C0644 5 file\nhello\x00",
+			entries: []entry{{"file", 0644, "hello"}},
+			ok:      true,
+		},
+		{
+			name:    "renamed file",
+			input:   "C0600 2 file\nhi\x00",
+			rename:  "other",
+			entries: []entry{{"other", 0600, "hi"}},
+			ok:      true,
+		},
+		{
+			name:      "directory",
+			input:     "D0755 0 dir\nC0644 1 a\na\x00D0700 0 sub\nC0644 1 b\nb\x00E\nE\nC0644 1 c\nc\x00",
+			recursive: true,
+			entries:   []entry{{"dir/", 0755, ""}, {"dir/a", 0644, "a"}, {"dir/sub/", 0700, ""}, {"dir/sub/b", 0644, "b"}, {"c", 0644, "c"}},
+			ok:        true,
+		},
+		{
+			name:    "preserved times",
+			input:   "T1600000000 0 1600000000 0\nC0644 1 file\nx\x00",
+			entries: []entry{{"file", 0644, "x"}},
+			ok:      true,
+		},
+		{
+			name:  "warning from client",
+			input: "\x01some warning\n",
+			ok:    true,
+		},
+		{
+			name:  "fatal error from client",
+			input: "\x02some error\n",
+		},
+		{
+			name:  "directory without -r",
+			input: "D0755 0 dir\n",
+		},
+		{
+			name:      "end without directory",
+			input:     "E\n",
+			recursive: true,
+		},
+		{
+			name:      "escaping directory name",
+			input:     "D0755 0 ..\nC0644 1 file\nx\x00",
+			recursive: true,
+		},
+		{
+			name:  "escaping file name",
+			input: "C0644 1 ../file\nx\x00",
+		},
+		{
+			name:  "absolute file name",
+			input: "C0644 1 /etc/passwd\nx\x00",
+		},
+		{
+			name:  "truncated header",
+			input: "C0644 1",
+		},
+		{
+			name:  "header without name",
+			input: "C0644 1\nx\x00",
+		},
+		{
+			name:  "content shorter than size",
+			input: "C0644 10 file\nshort",
+		},
+		{
+			name:  "content longer than size",
+			input: "C0644 2 file\ntoo long\x00",
+		},
+		{
+			name:  "missing ack after content",
+			input: "C0644 2 file\nhi",
+		},
+		{
+			name:  "bad times",
+			input: "Tnow\nC0644 1 file\nx\x00",
+		},
+		{
+			name:  "empty message",
+			input: "\n",
+		},
+		{
+			name:  "unknown message",
+			input: "X\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var archive, output bytes.Buffer
+			tw := tar.NewWriter(&archive)
+
+			err := scpReceive(&output, bufio.NewReader(strings.NewReader(test.input)), tw, SCPOptions{Sink: true, Recursive: test.recursive}, test.rename)
+			if (err == nil) != test.ok {
+				t.Fatalf("expected ok=%t, got error %v", test.ok, err)
+			}
+			if !test.ok {
+				return
+			}
+			if err = tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries []entry
+			tr := tar.NewReader(&archive)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				content, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, entry{header.Name, header.Mode, string(content)})
+			}
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("expected entries %v, got %v", test.entries, entries)
+			}
+		})
+	}
+}
+
+func TestReadSCPAck(t *testing.T) {
+	tests := []struct {
+		input   string
+		message string
+		ok      bool
+	}{
+		{"\x00", "", true},
+		{"\x01warning\n", "warning", false},
+		{"\x02fatal\n", "fatal", false},
+		{"\x02truncated", "truncated", false},
+		{"", "EOF", false},
+	}
+
+	for _, test := range tests {
+		err := readSCPAck(bufio.NewReader(strings.NewReader(test.input)))
+		if (err == nil) != test.ok {
+			t.Errorf("readSCPAck(%q): expected ok=%t, got error %v", test.input, test.ok, err)
+		} else if err != nil && err.Error() != test.message {
+			t.Errorf("readSCPAck(%q): expected message %q, got %q", test.input, test.message, err.Error())
+		}
+	}
+}
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		options SCPOptions
+		ok      bool
+	}{
+		{"scp -t /tmp", SCPOptions{Sink: true, Paths: []string{"/tmp"}}, true},
+		{"scp -r -p -d -t -- dir", SCPOptions{Sink: true, Recursive: true, Preserve: true, TargetIsDir: true, Paths: []string{"dir"}}, true},
+		{"/usr/bin/scp -rf a b", SCPOptions{Source: true, Recursive: true, Paths: []string{"a", "b"}}, true},
+		{"scp -v -f 'file with spaces'", SCPOptions{Source: true, Paths: []string{"file with spaces"}}, true},
+		{"scp -f -- -file", SCPOptions{Source: true, Paths: []string{"-file"}}, true},
+
+		{"", SCPOptions{}, false},
+		{"ls -t /tmp", SCPOptions{}, false},
+		{"scp /tmp", SCPOptions{}, false},
+		{"scp -t", SCPOptions{}, false},
+		{"scp -t a b", SCPOptions{}, false},
+		{"scp -t -f a", SCPOptions{}, false},
+		{"scp -t 'unterminated", SCPOptions{}, false},
+	}
+
+	for _, test := range tests {
+		options, ok := ParseSCPCommand(test.command)
+		if ok != test.ok || !reflect.DeepEqual(options, test.options) {
+			t.Errorf("ParseSCPCommand(%q) = %+v, %t, expected %+v, %t", test.command, options, ok, test.options, test.ok)
+		}
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		command string
+		words   []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"  a  b\tc\n", []string{"a", "b", "c"}, true},
+		{"'a b' \"c d\"", []string{"a b", "c d"}, true},
+		{"a\\ b", []string{"a b"}, true},
+		{"''", []string{""}, true},
+		{"'a\\b'", []string{"a\\b"}, true},
+		{"\"a\\\"b\\c\"", []string{"a\"b\\c"}, true},
+		{"a'b'\"c\"", []string{"abc"}, true},
+		{"'unterminated", nil, false},
+		{"\"unterminated", nil, false},
+	}
+
+	for _, test := range tests {
+		words, err := splitShellWords(test.command)
+		if (err == nil) != test.ok || !reflect.DeepEqual(words, test.words) {
+			t.Errorf("splitShellWords(%q) = %q, %v, expected %q, ok=%t", test.command, words, err, test.words, test.ok)
+		}
+	}
+}
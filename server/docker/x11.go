@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"io"
+	"path"
+	"strconv"
+	"time"
+)
+
+// xauthFamilyWild matches every address in an Xauthority entry
+const xauthFamilyWild = 0xffff
+
+// WriteXauthority writes an Xauthority file with the given x11 cookie for
+// the display into the container and returns its path. The file is owned by
+// the container user, so the x11 clients inside the container can read it
+func (ic *InteractiveContainer) WriteXauthority(ctx context.Context, display int, protocol, cookie string) (string, error) {
+	rawCookie, err := hex.DecodeString(cookie)
+	if err != nil {
+		return "", fmt.Errorf("invalid x11 cookie: %v", err)
+	}
+
+	uid, gid, err := ic.UserIDs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	rawName := make([]byte, 8)
+	if _, err = rand.Read(rawName); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf(".docker4ssh-xauth-%s", hex.EncodeToString(rawName))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(xauthFamilyWild))
+	for _, field := range [][]byte{nil, []byte(strconv.Itoa(display)), []byte(protocol), rawCookie} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(field)))
+		buf.Write(field)
+	}
+
+	err = ic.CopyTarTo(ctx, "/tmp", types.CopyToContainerOptions{CopyUIDGID: true}, func(tw *tar.Writer) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Uid:     uid,
+			Gid:     gid,
+			Size:    int64(buf.Len()),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join("/tmp", name), nil
+}
+
+// RemoveFile removes a file inside the container
+func (ic *InteractiveContainer) RemoveFile(ctx context.Context, file string) error {
+	conn, err := ic.ExecuteConn(ctx, "rm", "-f", file)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = io.Copy(io.Discard, conn)
+	return err
+}
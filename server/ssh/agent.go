@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"docker4ssh/docker"
+	"encoding/hex"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// startAgentForwarding creates a socket in the socket directory of the
+// container which relays every connection to the ssh agent of the client.
+// The socket is placed in a private directory and only the container user
+// may access it. Returns the path of the socket inside the container and a
+// function to stop the forwarding
+func startAgentForwarding(ctx context.Context, session *Session, container *docker.SimpleContainer) (string, func(), error) {
+	rawName := make([]byte, 8)
+	if _, err := rand.Read(rawName); err != nil {
+		return "", nil, err
+	}
+
+	hostDir, containerDir, ok := container.SocketPath(fmt.Sprintf("agent.%s", hex.EncodeToString(rawName)))
+	if !ok {
+		return "", nil, fmt.Errorf("container %s has no socket directory", container.ContainerID)
+	}
+
+	uid, gid, err := container.UserIDs(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err = os.Mkdir(hostDir, 0700); err != nil {
+		return "", nil, err
+	}
+	hostPath := filepath.Join(hostDir, "agent")
+	listener, err := net.Listen("unix", hostPath)
+	if err != nil {
+		os.RemoveAll(hostDir)
+		return "", nil, err
+	}
+	if err = setSocketOwner(hostDir, hostPath, uid, gid); err != nil {
+		listener.Close()
+		os.RemoveAll(hostDir)
+		return "", nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ch, requests, err := session.OpenChannel("auth-agent@openssh.com", nil)
+				if err != nil {
+					zap.S().Debugf("Client of user %s rejected agent connection: %v", session.ID, err)
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+
+				pipe(ch, conn)
+			}()
+		}
+	}()
+
+	zap.S().Debugf("Started agent forwarding for user %s on %s", session.ID, hostPath)
+
+	return path.Join(containerDir, "agent"), func() {
+		listener.Close()
+		os.RemoveAll(hostDir)
+	}, nil
+}
+
+// setSocketOwner gives the socket and its directory to the container user,
+// who may not be the same as the user docker4ssh runs with
+func setSocketOwner(dir, socket string, uid, gid int) error {
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	if err := os.Chown(socket, uid, gid); err != nil {
+		return err
+	}
+	return os.Chown(dir, uid, gid)
+}
@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const sourceAddressCriticalOption = "source-address"
+
+// newCertChecker returns a checker which accepts user certificates signed by
+// one of the keys in the trusted user ca keys file
+func newCertChecker(trustedUserCAKeys, revokedSerials string) (*ssh.CertChecker, error) {
+	caKeys, err := loadCAKeys(trustedUserCAKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, caKey := range caKeys {
+				if bytes.Equal(caKey.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			if revokedSerials == "" {
+				return false
+			}
+			// the file is read on every check, so revocations take effect
+			// without restarting the server
+			revoked, err := isSerialRevoked(revokedSerials, cert.Serial)
+			if err != nil {
+				// better reject a valid certificate than accept a revoked one
+				zap.S().Errorf("Failed to read revoked serials file %s: %v", revokedSerials, err)
+				return true
+			}
+			return revoked
+		},
+	}, nil
+}
+
+// authenticateCertificate checks if the certificate is valid for the user and
+// returns the permissions of the profile whose username matches the user.
+// The user must be one of the certificate principals
+func authenticateCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate, checker *ssh.CertChecker) (*ssh.Permissions, error) {
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("%s tried to connect with user %s but offered a certificate without principals", conn.RemoteAddr().String(), conn.User())
+	}
+	// checks the signature, validity window, principals and revocation
+	if _, err := checker.Authenticate(conn, cert); err != nil {
+		return nil, fmt.Errorf("%s tried to connect with user %s but offered an invalid certificate (serial %d): %v", conn.RemoteAddr().String(), conn.User(), cert.Serial, err)
+	}
+
+	profile, ok := profiles.MatchUsername(conn.User(), conn.RemoteAddr())
+	if !ok {
+		return nil, fmt.Errorf("%s tried to connect with user %s but no profile matches the certificate principal and address", conn.RemoteAddr().String(), conn.User())
+	}
+
+	permissions := profilePermissions(profile.Name())
+	// the ssh library enforces the source address if it is part of the
+	// returned critical options
+	if sourceAddress, ok := cert.CriticalOptions[sourceAddressCriticalOption]; ok {
+		permissions.CriticalOptions[sourceAddressCriticalOption] = sourceAddress
+	}
+
+	return withTOTP(permissions, profile.TOTPSecret)
+}
+
+// loadCAKeys reads all public keys from a file in the authorized_keys format
+func loadCAKeys(path string) ([]ssh.PublicKey, error) {
+	rest, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var key ssh.PublicKey
+		if key, _, _, rest, err = ssh.ParseAuthorizedKey(rest); err != nil {
+			return nil, fmt.Errorf("failed to parse ca key in %s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s contains no ca keys", path)
+	}
+	return keys, nil
+}
+
+// isSerialRevoked checks if the serial is listed in the revoked serials file.
+// The file contains one serial per line, empty lines and lines starting with
+// '#' are ignored
+func isSerialRevoked(path string, serial uint64) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		revokedSerial, err := strconv.ParseUint(line, 0, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid serial '%s'", line)
+		}
+		if revokedSerial == serial {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -3,53 +3,352 @@ package ssh
 import (
 	c "docker4ssh/config"
 	"docker4ssh/database"
+	"docker4ssh/utils"
+	"errors"
 	"fmt"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
+	"strings"
+	"time"
 )
 
 func NewSSHConfig(config *c.Config) (*ssh.ServerConfig, error) {
 	db := database.GetDatabase()
 
+	passwordCallback := func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		var permissions *ssh.Permissions
+		var secret string
+		if profile, ok := profiles.Match(conn.User(), password, conn.RemoteAddr()); ok {
+			permissions, secret = profilePermissions(profile.Name()), profile.TOTPSecret
+		} else if config.Profile.Dynamic.Enable && dynamicProfile.Match(conn.User(), password, conn.RemoteAddr()) {
+			permissions, secret = dynamicPermissions(conn.User()), dynamicProfile.TOTPSecret
+		}
+		// saved containers take precedence over profiles
+		if containerIDs := db.GetContainersByAuth(conn.User(), password); len(containerIDs) > 0 {
+			return withContainers(containerIDs, permissions, secret)
+		} else if permissions != nil {
+			return withTOTP(permissions, secret)
+		}
+		// i think logging the wrong password is a bit unsafe.
+		// if you have e.g. just a type in it isn't very well to see your nearly correct password in the logs
+		return nil, fmt.Errorf("%s tried to connect with user %s but entered wrong a password", conn.RemoteAddr().String(), conn.User())
+	}
+
+	var err error
+	if shadowKeys, err = loadShadowKeys(config.SSH.Shadow.ViewerKeys, config.SSH.Shadow.CopilotKeys); err != nil {
+		return nil, err
+	}
+
+	var certChecker *ssh.CertChecker
+	if config.SSH.TrustedUserCAKeys != "" {
+		var err error
+		if certChecker, err = newCertChecker(config.SSH.TrustedUserCAKeys, config.SSH.RevokedSerials); err != nil {
+			return nil, err
+		}
+	}
+
+	publicKeyCallback := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if containerID, copilot, ok := parseShadowUser(conn.User()); ok && len(shadowKeys) > 0 {
+			return authenticateShadow(conn, key, containerID, copilot)
+		}
+		if cert, ok := key.(*ssh.Certificate); ok && certChecker != nil {
+			return authenticateCertificate(conn, cert, certChecker)
+		}
+		var permissions *ssh.Permissions
+		var secret string
+		if profile, ok := profiles.MatchPublicKey(conn.User(), key, conn.RemoteAddr()); ok {
+			permissions, secret = profilePermissions(profile.Name()), profile.TOTPSecret
+		} else if config.Profile.Dynamic.Enable && dynamicProfile.MatchPublicKey(conn.User(), key, conn.RemoteAddr()) {
+			permissions, secret = dynamicPermissions(conn.User()), dynamicProfile.TOTPSecret
+		}
+		if containerIDs := db.GetContainersByPublicKey(conn.User(), key); len(containerIDs) > 0 {
+			return withContainers(containerIDs, permissions, secret)
+		} else if permissions != nil {
+			return withTOTP(permissions, secret)
+		}
+		return nil, fmt.Errorf("%s tried to connect with user %s but offered an unknown public key (%s)", conn.RemoteAddr().String(), conn.User(), ssh.FingerprintSHA256(key))
+	}
+
 	sshConfig := &ssh.ServerConfig{
-		MaxAuthTries: 3,
-		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-			if containerID, exists := db.GetContainerByAuth(database.NewUnsafeAuth(conn.User(), password)); exists && containerID != "" {
-				return &ssh.Permissions{
-					CriticalOptions: map[string]string{
-						"containerID": containerID,
-					},
-				}, nil
-			} else if profile, ok := profiles.Match(conn.User(), password); ok {
-				return &ssh.Permissions{
-					CriticalOptions: map[string]string{
-						"profile": profile.Name(),
-					},
-				}, nil
-			} else if config.Profile.Dynamic.Enable && dynamicProfile.Match(conn.User(), password) {
-				return &ssh.Permissions{
-					CriticalOptions: map[string]string{
-						"profile": "dynamic",
-						"image":   conn.User(),
-					},
-				}, nil
+		MaxAuthTries:     3,
+		PasswordCallback: passwordCallback,
+		BannerCallback: func(conn ssh.ConnMetadata) string {
+			return banner(config, conn)
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			permissions, err := publicKeyCallback(conn, key)
+			return withPublicKey(key, permissions, err)
+		},
+		// clients which have password authentication disabled can enter the
+		// password via keyboard-interactive
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			} else if len(answers) != 1 {
+				return nil, fmt.Errorf("%s with user %s sent an invalid keyboard-interactive response", conn.RemoteAddr().String(), conn.User())
 			}
-			// i think logging the wrong password is a bit unsafe.
-			// if you have e.g. just a type in it isn't very well to see your nearly correct password in the logs
-			return nil, fmt.Errorf("%s tried to connect with user %s but entered wrong a password", conn.RemoteAddr().String(), conn.User())
+			return passwordCallback(conn, []byte(answers[0]))
 		},
 	}
-	sshConfig.SetDefaults()
+	limit := config.SSH.Limit
+	if err := connLimiter.configure(limit.MaxAuthFailures, limit.FailureWindow, limit.BanDuration, limit.MaxUnauthenticated, limit.MaxHandshakes); err != nil {
+		return nil, err
+	}
+	sshConfig.AuthLogCallback = connLimiter.authLog
+
+	if config.SSH.Crypto.MaxAuthTries != 0 {
+		// a negative value means unlimited tries
+		sshConfig.MaxAuthTries = config.SSH.Crypto.MaxAuthTries
+	}
 
-	key, err := parseSSHPrivateKey(config.SSH.Keyfile, []byte(config.SSH.Passphrase))
+	algorithms, err := config.CryptoAlgorithms()
 	if err != nil {
 		return nil, err
 	}
-	sshConfig.AddHostKey(key)
+	// empty lists are filled with the library defaults
+	sshConfig.KeyExchanges = algorithms.KeyExchanges
+	sshConfig.Ciphers = algorithms.Ciphers
+	sshConfig.MACs = algorithms.MACs
+	sshConfig.SetDefaults()
+
+	if hostKeys, err = loadHostKeys(config); err != nil {
+		return nil, err
+	}
+	usedTypes := map[string]bool{}
+	for _, hostKey := range hostKeys {
+		// AddHostKey replaces keys of the same type, but the first one
+		// should be used. The others are only announced to the clients
+		keyType := hostKey.PublicKey().Type()
+		if usedTypes[keyType] {
+			continue
+		}
+		signer, ok, err := restrictHostKeyAlgorithms(hostKey, algorithms.HostKeyAlgorithms)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			zap.S().Debugf("Host key type %s is not used since none of its algorithms is allowed", keyType)
+			continue
+		}
+		sshConfig.AddHostKey(signer)
+		usedTypes[keyType] = true
+	}
+	if len(usedTypes) == 0 {
+		return nil, fmt.Errorf("no host key matches the allowed host key algorithms")
+	}
 
 	return sshConfig, nil
 }
 
+// restrictHostKeyAlgorithms returns a signer which only signs with the allowed
+// algorithms. ok is false if the key supports none of them. If no algorithms
+// are given, the signer is returned unchanged
+func restrictHostKeyAlgorithms(signer ssh.Signer, allowed []string) (ssh.Signer, bool, error) {
+	if len(allowed) == 0 {
+		return signer, true, nil
+	}
+
+	keyAlgorithms := []string{signer.PublicKey().Type()}
+	if keyAlgorithms[0] == ssh.KeyAlgoRSA {
+		keyAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	var algorithms []string
+	for _, algorithm := range allowed {
+		for _, keyAlgorithm := range keyAlgorithms {
+			if algorithm == keyAlgorithm {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	if len(algorithms) == 0 {
+		return nil, false, nil
+	}
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, false, fmt.Errorf("host key of type %s does not support algorithm selection", signer.PublicKey().Type())
+	}
+	multiAlgorithmSigner, err := ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+	if err != nil {
+		return nil, false, err
+	}
+	return multiAlgorithmSigner, true, nil
+}
+
+// withTOTP returns the permissions if no totp secret is given. Otherwise the
+// authentication only partially succeeded and the client has to enter a valid
+// totp code via keyboard-interactive to get the permissions
+func withTOTP(permissions *ssh.Permissions, secret string) (*ssh.Permissions, error) {
+	if secret == "" {
+		return permissions, nil
+	}
+
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client("", "", []string{"Verification code: "}, []bool{true})
+				if err != nil {
+					return nil, err
+				}
+				if len(answers) != 1 || !utils.ValidateTOTP(secret, answers[0], time.Now()) {
+					return nil, fmt.Errorf("%s tried to connect with user %s but entered a wrong verification code", conn.RemoteAddr().String(), conn.User())
+				}
+				return permissions, nil
+			},
+		},
+	}
+}
+
+// withPublicKey stores the fingerprint of the public key the user has
+// authenticated with in the permissions. It identifies the user across
+// connections, e.g. to find the container with the detached shells of the
+// user. For certificates, the fingerprint of the certified key is used
+func withPublicKey(key ssh.PublicKey, permissions *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	setFingerprint := func(permissions *ssh.Permissions) {
+		if permissions == nil {
+			return
+		}
+		if permissions.Extensions == nil {
+			permissions.Extensions = map[string]string{}
+		}
+		permissions.Extensions["publicKey"] = fingerprint
+	}
+
+	var partialSuccessError *ssh.PartialSuccessError
+	if errors.As(err, &partialSuccessError) && partialSuccessError.Next.KeyboardInteractiveCallback != nil {
+		// the permissions are returned after the second factor
+		next := partialSuccessError.Next.KeyboardInteractiveCallback
+		partialSuccessError.Next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			permissions, err := next(conn, client)
+			setFingerprint(permissions)
+			return permissions, err
+		}
+		return nil, partialSuccessError
+	}
+	setFingerprint(permissions)
+	return permissions, err
+}
+
+// withContainers returns the permissions for a user whose credentials match
+// the saved containers. If multiple containers match, the user selects one
+// after the login. fresh are the permissions of a profile which matches the
+// credentials too, it lets the user create a new container instead. If one
+// of them requires a totp second factor, only those whose code was entered
+// correctly or which require none are offered
+func withContainers(containerIDs []string, fresh *ssh.Permissions, freshSecret string) (*ssh.Permissions, error) {
+	if len(containerIDs) == 1 {
+		return withTOTP(containerPermissions(containerIDs[0]), containerTOTPSecret(containerIDs[0]))
+	}
+
+	secrets := map[string]string{}
+	required := freshSecret != ""
+	for _, containerID := range containerIDs {
+		if secret := containerTOTPSecret(containerID); secret != "" {
+			secrets[containerID] = secret
+			required = true
+		}
+	}
+	if !required {
+		return choicePermissions(containerIDs, fresh), nil
+	}
+
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client("", "", []string{"Verification code: "}, []bool{true})
+				if err != nil {
+					return nil, err
+				}
+				valid := func(secret string) bool {
+					return secret == "" || (len(answers) == 1 && utils.ValidateTOTP(secret, answers[0], time.Now()))
+				}
+
+				var allowed []string
+				for _, containerID := range containerIDs {
+					if valid(secrets[containerID]) {
+						allowed = append(allowed, containerID)
+					}
+				}
+				allowedFresh := fresh
+				if !valid(freshSecret) {
+					allowedFresh = nil
+				}
+
+				if len(allowed) == 0 && allowedFresh == nil {
+					return nil, fmt.Errorf("%s tried to connect with user %s but entered a wrong verification code", conn.RemoteAddr().String(), conn.User())
+				} else if len(allowed) == 0 {
+					return allowedFresh, nil
+				} else if len(allowed) == 1 && allowedFresh == nil {
+					return containerPermissions(allowed[0]), nil
+				}
+				return choicePermissions(allowed, allowedFresh), nil
+			},
+		},
+	}
+}
+
+// choicePermissions returns the permissions for a user who has to select one
+// of the containers after the login. The first container is used if no
+// selection is possible, e.g. for commands without pty. The options of fresh
+// are prefixed with 'fresh.'
+func choicePermissions(containerIDs []string, fresh *ssh.Permissions) *ssh.Permissions {
+	permissions := containerPermissions(containerIDs[0])
+	permissions.CriticalOptions["containerIDs"] = strings.Join(containerIDs, ",")
+	if fresh != nil {
+		for key, value := range fresh.CriticalOptions {
+			permissions.CriticalOptions["fresh."+key] = value
+		}
+	}
+	return permissions
+}
+
+// containerTOTPSecret returns the totp secret of a saved container or an
+// empty string if it has none
+func containerTOTPSecret(containerID string) string {
+	if auth, ok := database.GetDatabase().GetAuthByContainer(containerID); ok && auth.TOTPSecret != nil {
+		return *auth.TOTPSecret
+	}
+	return ""
+}
+
+// containerPermissions returns the permissions for a user who authenticated
+// against a saved container
+func containerPermissions(containerID string) *ssh.Permissions {
+	return &ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"containerID": containerID,
+		},
+	}
+}
+
+// profilePermissions returns the permissions for a user who authenticated
+// against a profile from the profile directory
+func profilePermissions(name string) *ssh.Permissions {
+	return &ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"profile": name,
+		},
+	}
+}
+
+// dynamicPermissions returns the permissions for a user who authenticated
+// against the dynamic profile. The image is the username
+func dynamicPermissions(image string) *ssh.Permissions {
+	return &ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"profile": "dynamic",
+			"image":   image,
+		},
+	}
+}
+
 func parseSSHPrivateKey(path string, password []byte) (ssh.Signer, error) {
 	keyBytes, err := ioutil.ReadFile(path)
 	if err != nil {
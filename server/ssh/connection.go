@@ -1,7 +1,6 @@
 package ssh
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"docker4ssh/database"
@@ -9,18 +8,60 @@ import (
 	"docker4ssh/utils"
 	"fmt"
 	"go.uber.org/zap"
+	"io"
 	"strconv"
 	"sync"
 	"time"
 )
 
 var (
-	allContainers []*docker.InteractiveContainer
+	// allContainers contains the containers of all connections and is guarded
+	// by allContainersMutex. Use the functions below to access it
+	allContainers      []*docker.InteractiveContainer
+	allContainersMutex sync.Mutex
 )
 
+// containers returns a copy of all containers which are used by connections
+func containers() []*docker.InteractiveContainer {
+	allContainersMutex.Lock()
+	defer allContainersMutex.Unlock()
+
+	return append([]*docker.InteractiveContainer{}, allContainers...)
+}
+
+// addContainer adds the container to the global container scope if it is
+// not already in it
+func addContainer(container *docker.InteractiveContainer) {
+	allContainersMutex.Lock()
+	defer allContainersMutex.Unlock()
+
+	for _, cont := range allContainers {
+		if cont == container {
+			return
+		}
+	}
+	allContainers = append(allContainers, container)
+}
+
+// removeContainer removes the container from the global container scope.
+// Returns false if it was not in it
+func removeContainer(container *docker.InteractiveContainer) bool {
+	allContainersMutex.Lock()
+	defer allContainersMutex.Unlock()
+
+	for i, cont := range allContainers {
+		if cont == container {
+			allContainers[i] = allContainers[len(allContainers)-1]
+			allContainers = allContainers[:len(allContainers)-1]
+			return true
+		}
+	}
+	return false
+}
+
 func closeAllContainers(ctx context.Context) {
 	var wg sync.WaitGroup
-	for _, container := range allContainers {
+	for _, container := range containers() {
 		wg.Add(1)
 		container := container
 		go func() {
@@ -31,100 +72,220 @@ func closeAllContainers(ctx context.Context) {
 	wg.Wait()
 }
 
-func connection(client *docker.Client, user *User) {
+// connection serves the user session in its container and returns the exit
+// status of the process which was running in it. The exit status is nil if
+// it is unknown
+func connection(client *docker.Client, session *Session) (exitStatus *docker.ExitStatus) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	container, ok := getContainer(ctx, client, user)
+	container, ok := acquireContainer(ctx, client, session)
 	if !ok {
-		zap.S().Errorf("Failed to create container for %s", user.ID)
-		return
-	}
-
-	user.Container = container.SimpleContainer
-
-	var found bool
-	for _, cont := range allContainers {
-		if cont == container {
-			found = true
-		}
-	}
-	if !found {
-		allContainers = append(allContainers, container)
+		zap.S().Errorf("Failed to create container for %s", session.ID)
+		return nil
 	}
+	defer releaseContainer(ctx, session, container)
 
 	// check if the container is running and start it if not
 	if running, err := container.Running(ctx); err == nil && !running {
 		if err = container.Start(ctx); err != nil {
 			zap.S().Errorf("Failed to start container %s: %v", container.ContainerID, err)
-			fmt.Fprintln(user.Terminal, "Failed to start container")
-			return
+			fmt.Fprintln(session.Terminal, "Failed to start container")
+			return nil
 		}
 		zap.S().Infof("Started container %s with internal id '%s', ip '%s'", container.ContainerID, container.ContainerID, container.Network.IP)
 	} else if err != nil {
 		zap.S().Errorf("Failed to get container running state: %v", err)
-		fmt.Fprintln(user.Terminal, "Failed to check container running state")
+		fmt.Fprintln(session.Terminal, "Failed to check container running state")
 	}
 
-	config := container.Config()
-	if user.Profile.StartupInformation {
-		buf := &bytes.Buffer{}
-		fmt.Fprintf(buf, "┌───Container────────────────┐\r\n")
-		fmt.Fprintf(buf, "│ Container ID: %-12s │\r\n", container.ContainerID)
-		fmt.Fprintf(buf, "│ Network Mode: %-12s │\r\n", config.NetworkMode.Name())
-		fmt.Fprintf(buf, "│ Configurable: %-12t │\r\n", config.Configurable)
-		fmt.Fprintf(buf, "│ Run Level:    %-12s │\r\n", config.RunLevel.Name())
-		fmt.Fprintf(buf, "│ Exit After:   %-12s │\r\n", config.ExitAfter)
-		fmt.Fprintf(buf, "│ Keep On Exit: %-12t │\r\n", config.KeepOnExit)
-		fmt.Fprintf(buf, "└──────────────Information───┘\r\n")
-		user.Terminal.Write(buf.Bytes())
+	// the motd is only shown for interactive sessions to not mess up the output of commands
+	if session.Profile.StartupInformation && session.Terminal.Command == "" && session.Terminal.Subsystem == "" {
+		if motd, err := renderMotd(session, container); err != nil {
+			zap.S().Errorf("Failed to render motd of profile %s: %v", session.Profile.Name(), err)
+		} else {
+			session.Terminal.Write(motd)
+		}
 	}
 
-	// start a new terminal session
-	if err := container.Terminal(ctx, user.Terminal); err != nil {
-		zap.S().Errorf("Failed to serve %s terminal: %v", container.ContainerID, err)
-		fmt.Fprintln(user.Terminal, "Failed to serve terminal")
+	if session.Terminal.AgentForwarding {
+		if socket, stop, err := startAgentForwarding(ctx, session, container.SimpleContainer); err != nil {
+			zap.S().Warnf("Failed to start agent forwarding for user %s: %v", session.ID, err)
+		} else {
+			defer stop()
+			session.Terminal.Env = append(session.Terminal.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", socket))
+		}
 	}
 
-	if config.RunLevel == docker.User && container.TerminalCount() == 0 {
-		if err := container.Stop(ctx); err != nil {
-			zap.S().Errorf("Error occoured while stopping container %s: %v", container.ContainerID, err)
+	if session.Terminal.X11 != nil {
+		if env, stop, err := startX11Forwarding(ctx, session, container); err != nil {
+			zap.S().Warnf("Failed to start x11 forwarding for user %s: %v", session.ID, err)
 		} else {
-			lenBefore := len(allContainers)
-			for i, cont := range allContainers {
-				if cont == container {
-					allContainers[i] = allContainers[lenBefore-1]
-					allContainers = allContainers[:lenBefore-1]
-					break
-				}
+			defer stop()
+			session.Terminal.Env = append(session.Terminal.Env, env...)
+		}
+	}
+
+	// start a new terminal session
+	var err error
+	var cleanupSubsystem func()
+	if scpOptions, ok := docker.ParseSCPCommand(session.Terminal.Command); ok {
+		// scp is served by docker4ssh itself, so it works even if the image has no scp binary
+		if exitStatus, err = container.SCP(ctx, session.Terminal, scpOptions); err != nil {
+			zap.S().Errorf("Failed to serve scp for %s: %v", container.ContainerID, err)
+		}
+	} else if cleanupSubsystem, err = prepareSubsystem(ctx, container, session); err != nil {
+		zap.S().Errorf("Failed to prepare %s subsystem for %s: %v", session.Terminal.Subsystem, container.ContainerID, err)
+		fmt.Fprintf(session.Terminal.ErrorWriter(), "Failed to start %s subsystem\n", session.Terminal.Subsystem)
+	} else {
+		defer cleanupSubsystem()
+
+		// the terminal gets ended by the watcher if the idle timeout or the
+		// maximal session duration is exceeded
+		terminalCtx, terminalCancel := context.WithCancel(ctx)
+		go watchSessionLimits(terminalCtx, session, terminalCancel)
+
+		session.Terminal.Detachable = sessionDetachable(session)
+		session.Terminal.DetachTimeout = detachTimeout(session)
+
+		// only sessions with a pty are recorded, the output of commands and
+		// subsystems is not meant to be displayed in a terminal
+		if session.Terminal.Pty {
+			if recorder, err := startRecording(session, container); err != nil {
+				zap.S().Errorf("Failed to start recording of session for user %s: %v", session.ID, err)
+			} else if recorder != nil {
+				session.Terminal.SetRecorder(recorder)
+				defer recorder.Close()
 			}
-			if lenBefore == len(allContainers) {
-				zap.S().Warnf("Stopped container %s, but failed to remove it from the global container scope", container.ContainerID)
-			} else {
-				zap.S().Infof("Stopped container %s", container.ContainerID)
+		}
+
+		var detachable *docker.DetachableTerminal
+		if session.Terminal.Detachable && session.Terminal.Pty && session.Terminal.Command == "" {
+			detachable = selectDetachableTerminal(session, container)
+		}
+		if detachable != nil {
+			exitStatus, err = container.Reattach(terminalCtx, detachable, session.Terminal)
+			if err == docker.ErrTerminalAttached {
+				// another session has attached to it in the meantime
+				fmt.Fprint(session.Terminal, "The shell was attached by another session, starting a new one\r\n")
+				detachable = nil
 			}
 		}
+		if detachable == nil {
+			exitStatus, err = container.Terminal(terminalCtx, session.Terminal)
+		}
+		terminalCancel()
+		if err != nil {
+			zap.S().Errorf("Failed to serve %s terminal: %v", container.ContainerID, err)
+			fmt.Fprintln(session.Terminal, "Failed to serve terminal")
+		}
+	}
+
+	zap.S().Infof("Stopped session for user %s", session.ID)
+
+	return exitStatus
+}
+
+// acquireContainer returns the container of the session. The container is
+// created or resolved by the first session of the connection, all further
+// sessions share it
+func acquireContainer(ctx context.Context, client *docker.Client, session *Session) (*docker.InteractiveContainer, bool) {
+	session.containerMutex.Lock()
+	defer session.containerMutex.Unlock()
+
+	if session.container == nil {
+		if len(session.candidates) > 1 && !selectContainer(ctx, client, session) {
+			return nil, false
+		}
+		container, ok := getContainer(ctx, client, session)
+		if !ok {
+			return nil, false
+		}
+		session.container = container
+		session.setContainer(container.SimpleContainer)
+
+		if err := database.GetDatabase().SetLastLogin(container.FullContainerID, time.Now()); err != nil {
+			zap.S().Warnf("Failed to update last login of container %s: %v", container.ContainerID, err)
+		}
+
+		addContainer(container)
 	}
+	session.sessions++
 
-	zap.S().Infof("Stopped session for user %s", user.ID)
+	return session.container, true
 }
 
-func getContainer(ctx context.Context, client *docker.Client, user *User) (container *docker.InteractiveContainer, ok bool) {
+// releaseContainer is called when a session has finished. If it was the last
+// session using the container, the container gets stopped if its run level
+// demands it
+func releaseContainer(ctx context.Context, session *Session, container *docker.InteractiveContainer) {
+	session.containerMutex.Lock()
+	defer session.containerMutex.Unlock()
+
+	session.sessions--
+	if session.sessions > 0 {
+		return
+	}
+
+	if len(container.DetachedTerminals()) > 0 {
+		// the container must keep running for the detached terminals
+		keepDetachedContainer(session, container)
+	} else if container.Config().RunLevel == docker.User && container.TerminalCount() == 0 {
+		if stopContainer(ctx, container) {
+			// the next session of the connection has to resolve the container again
+			session.container = nil
+			session.setContainer(nil)
+		}
+	}
+}
+
+// stopContainer stops the container and removes it from the global container
+// scope. Returns false if the container could not be stopped
+func stopContainer(ctx context.Context, container *docker.InteractiveContainer) bool {
+	if err := container.Stop(ctx); err != nil {
+		zap.S().Errorf("Error occoured while stopping container %s: %v", container.ContainerID, err)
+		return false
+	}
+
+	if !removeContainer(container) {
+		zap.S().Warnf("Stopped container %s, but failed to remove it from the global container scope", container.ContainerID)
+	} else {
+		zap.S().Infof("Stopped container %s", container.ContainerID)
+	}
+	return true
+}
+
+// prepareSubsystem sets the command which serves the requested subsystem.
+// The returned function must be called after the subsystem has ended
+func prepareSubsystem(ctx context.Context, container *docker.InteractiveContainer, session *Session) (func(), error) {
+	switch session.Terminal.Subsystem {
+	case "sftp":
+		command, cleanup, err := container.SFTPCommand(ctx)
+		if err != nil {
+			return nil, err
+		}
+		session.Terminal.Command = command
+		return cleanup, nil
+	}
+	return func() {}, nil
+}
+
+func getContainer(ctx context.Context, client *docker.Client, session *Session) (container *docker.InteractiveContainer, ok bool) {
 	db := database.GetDatabase()
 	var config docker.Config
 
 	// check if the user has a container (id) assigned
-	if user.Profile.ContainerID != "" {
-		for _, cont := range allContainers {
-			if cont.FullContainerID == user.Profile.ContainerID {
+	if session.Profile.ContainerID != "" {
+		for _, cont := range containers() {
+			if cont.FullContainerID == session.Profile.ContainerID {
 				return cont, true
 			}
 		}
 
-		settings, err := db.SettingsByContainerID(user.Profile.ContainerID)
+		settings, err := db.SettingsByContainerID(session.Profile.ContainerID)
 		if err != nil {
-			zap.S().Errorf("Failed to get stored container config for container %s: %v", user.Profile.ContainerID, err)
-			fmt.Fprintf(user.Terminal, "Could not connect to saved container")
+			zap.S().Errorf("Failed to get stored container config for container %s: %v", session.Profile.ContainerID, err)
+			fmt.Fprintf(session.Terminal, "Could not connect to saved container")
 			return nil, false
 		}
 
@@ -137,34 +298,42 @@ func getContainer(ctx context.Context, client *docker.Client, user *User) (conta
 			KeepOnExit:         *settings.KeepOnExit,
 		}
 
-		container, err = docker.InteractiveContainerFromID(ctx, client, config, user.Profile.ContainerID)
+		container, err = docker.InteractiveContainerFromID(ctx, client, config, session.Profile.ContainerID)
 		if err != nil {
-			zap.S().Errorf("Failed to get container from id %s: %v", user.Profile.ContainerID, err)
-			fmt.Fprintf(user.Terminal, "Failed to get container")
+			zap.S().Errorf("Failed to get container from id %s: %v", session.Profile.ContainerID, err)
+			fmt.Fprintf(session.Terminal, "Failed to get container")
 			return nil, false
 		}
 
-		zap.S().Infof("Re-used container %s for user %s", user.Profile.ContainerID, user.ID)
+		zap.S().Infof("Re-used container %s for user %s", session.Profile.ContainerID, session.ID)
+	} else if container, ok = getDetachedContainer(session); ok {
+		zap.S().Infof("Re-used container %s with detached terminals for user %s", container.ContainerID, session.ID)
+		return container, true
 	} else {
 		config = docker.Config{
-			NetworkMode:        docker.NetworkMode(user.Profile.NetworkMode),
-			Configurable:       user.Profile.Configurable,
-			RunLevel:           docker.RunLevel(user.Profile.RunLevel),
-			StartupInformation: user.Profile.StartupInformation,
-			ExitAfter:          user.Profile.ExitAfter,
-			KeepOnExit:         user.Profile.KeepOnExit,
+			NetworkMode:        docker.NetworkMode(session.Profile.NetworkMode),
+			Configurable:       session.Profile.Configurable,
+			RunLevel:           docker.RunLevel(session.Profile.RunLevel),
+			StartupInformation: session.Profile.StartupInformation,
+			ExitAfter:          session.Profile.ExitAfter,
+			KeepOnExit:         session.Profile.KeepOnExit,
 		}
 
-		image, out, err := docker.NewImage(ctx, client.Client, user.Profile.Image)
+		image, out, err := docker.NewImage(ctx, client.Client, session.Profile.Image)
 		if err != nil {
-			zap.S().Errorf("Failed to get '%s' image for profile %s: %v", user.Profile.Image, user.Profile.Name(), err)
-			fmt.Fprintf(user.Terminal, "Failed to get image %s", image.Ref())
+			zap.S().Errorf("Failed to get '%s' image for profile %s: %v", session.Profile.Image, session.Profile.Name(), err)
+			fmt.Fprintf(session.Terminal, "Failed to get image %s", image.Ref())
 			return nil, false
 		}
 		if out != nil {
-			if err := utils.DisplayJSONMessagesStream(out, user.Terminal, user.Terminal); err != nil {
+			var pullOut io.Writer = session.Terminal
+			if !session.Terminal.Pty {
+				// keep stdout clean for commands
+				pullOut = session.Terminal.ErrorWriter()
+			}
+			if err := utils.DisplayJSONMessagesStream(out, pullOut, session.Terminal); err != nil {
 				zap.S().Fatalf("Failed to fetch '%s' docker image: %v", image.Ref(), err)
-				fmt.Fprintf(user.Terminal, "Failed to fetch image %s", image.Ref())
+				fmt.Fprintf(session.Terminal, "Failed to fetch image %s", image.Ref())
 				return nil, false
 			}
 		}
@@ -172,11 +341,11 @@ func getContainer(ctx context.Context, client *docker.Client, user *User) (conta
 		container, err = docker.NewInteractiveContainer(ctx, client, config, image, strconv.Itoa(int(time.Now().Unix())))
 		if err != nil {
 			zap.S().Errorf("Failed to create interactive container: %v", err)
-			fmt.Fprintln(user.Terminal, "Failed to create interactive container")
+			fmt.Fprintln(session.Terminal, "Failed to create interactive container")
 			return nil, false
 		}
 
-		zap.S().Infof("Created new %s container (%s) for user %s", image.Ref(), container.ContainerID, user.ID)
+		zap.S().Infof("Created new %s container (%s) for user %s", image.Ref(), container.ContainerID, session.ID)
 	}
 
 	if _, err := db.SettingsByContainerID(container.FullContainerID); err != nil {
@@ -191,7 +360,7 @@ func getContainer(ctx context.Context, client *docker.Client, user *User) (conta
 				ExitAfter:          &config.ExitAfter,
 				KeepOnExit:         &config.KeepOnExit,
 			}); err != nil {
-				zap.S().Errorf("Failed to update settings for container %s for user %s: %v", container.ContainerID, user.ID, err)
+				zap.S().Errorf("Failed to update settings for container %s for user %s: %v", container.ContainerID, session.ID, err)
 				return nil, false
 			}
 		}
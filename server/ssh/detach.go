@@ -0,0 +1,175 @@
+package ssh
+
+import (
+	"context"
+	"docker4ssh/docker"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultDetachTimeout is how long a detached shell is kept if the profile has
+// no idle timeout
+const defaultDetachTimeout = time.Hour
+
+var (
+	// detachedContainers contains the containers of image profiles which
+	// have detached terminals, so the user gets the same container again on
+	// the next login. The key is built by detachedContainerKey
+	detachedContainers      = map[string]*docker.InteractiveContainer{}
+	detachedContainersMutex sync.Mutex
+)
+
+// detachedContainerKey returns the key of the container of the session in
+// detachedContainers. The username is shared by everyone who uses the same
+// profile or image, so the user is identified by the public key they have
+// authenticated with. ok is false if the user has authenticated otherwise,
+// their detached terminals are then only found via saved containers
+func detachedContainerKey(session *Session) (key string, ok bool) {
+	fingerprint, ok := session.Permissions.Extensions["publicKey"]
+	if !ok || fingerprint == "" {
+		return "", false
+	}
+	return fingerprint + "/" + session.Profile.Name() + "/" + session.Profile.Image, true
+}
+
+// sessionDetachable returns if the shells of the session may keep running
+// after the connection drops. This is only the case if the user can find
+// them again, i.e. if the container is saved or the user is identified by
+// their public key
+func sessionDetachable(session *Session) bool {
+	if !session.Profile.Detachable {
+		return false
+	}
+	if session.Profile.ContainerID != "" {
+		return true
+	}
+	_, identified := detachedContainerKey(session)
+	return identified
+}
+
+// detachTimeout returns how long a detached shell of the session is kept. A
+// detached shell is idle, so it is closed after the idle timeout
+func detachTimeout(session *Session) time.Duration {
+	if session.Profile.IdleTimeout > 0 {
+		return session.Profile.IdleTimeout
+	}
+	return defaultDetachTimeout
+}
+
+// getDetachedContainer returns the container with detached terminals which
+// the user has left with the same profile
+func getDetachedContainer(session *Session) (*docker.InteractiveContainer, bool) {
+	key, ok := detachedContainerKey(session)
+	if !ok {
+		return nil, false
+	}
+
+	detachedContainersMutex.Lock()
+	defer detachedContainersMutex.Unlock()
+
+	container, ok := detachedContainers[key]
+	if !ok || len(container.DetachedTerminals()) == 0 {
+		return nil, false
+	}
+	return container, true
+}
+
+// keepDetachedContainer remembers the container of the session until all its
+// detached terminals were reattached or have ended. If the container has no
+// terminals at all afterwards, it gets stopped if its run level demands it
+func keepDetachedContainer(session *Session, container *docker.InteractiveContainer) {
+	key, identified := detachedContainerKey(session)
+
+	// saved containers are found by their id anyway
+	if session.Profile.ContainerID == "" && identified {
+		detachedContainersMutex.Lock()
+		detachedContainers[key] = container
+		detachedContainersMutex.Unlock()
+	}
+
+	go func() {
+		container.WaitDetached()
+
+		detachedContainersMutex.Lock()
+		if identified && detachedContainers[key] == container {
+			delete(detachedContainers, key)
+		}
+		detachedContainersMutex.Unlock()
+
+		if container.Config().RunLevel == docker.User && container.TerminalCount() == 0 {
+			stopContainer(context.Background(), container)
+		}
+	}()
+}
+
+// selectDetachableTerminal lets the user choose one of the detached
+// terminals of the container to reattach to. Terminals which are attached in
+// another session are not offered. Returns nil if a new shell should be
+// started
+func selectDetachableTerminal(session *Session, container *docker.InteractiveContainer) *docker.DetachableTerminal {
+	detachables := container.DetachedTerminals()
+	if len(detachables) == 0 {
+		return nil
+	}
+
+	fmt.Fprint(session.Terminal, "This container has detached shells:\r\n")
+	for i, dt := range detachables {
+		detachedAt, _ := dt.Detached()
+		fmt.Fprintf(session.Terminal, "  [%d] started %s, detached %s ago\r\n", i+1, dt.Started.Format("2006-01-02 15:04:05"), time.Since(detachedAt).Round(time.Second))
+	}
+	fmt.Fprint(session.Terminal, "  [0] start a new shell\r\n")
+	fmt.Fprint(session.Terminal, "Select a shell [1]: ")
+
+	selected, ok := readSelection(session.Terminal, len(detachables), true)
+	if !ok || selected == 0 {
+		return nil
+	}
+	zap.S().Infof("User %s reattaches to terminal %d of %s", session.ID, detachables[selected-1].ID, container.ContainerID)
+	return detachables[selected-1]
+}
+
+// readSelection reads the number of a selected entry from a terminal in raw
+// mode. Returns a number between 1 and count, 1 if only enter was pressed and
+// 0 if it was entered and zero is true. Invalid entries are rejected and
+// the user is asked again. ok is false if the selection was cancelled
+func readSelection(rw io.ReadWriter, count int, zero bool) (selected int, ok bool) {
+	min := 1
+	if zero {
+		min = 0
+	}
+
+	var input []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := rw.Read(buf); err != nil {
+			return 0, false
+		}
+		switch b := buf[0]; {
+		case b >= '0' && b <= '9' && len(input) < 3:
+			input = append(input, b)
+			rw.Write(buf)
+		case (b == 0x7f || b == '\b') && len(input) > 0:
+			input = input[:len(input)-1]
+			rw.Write([]byte("\b \b"))
+		case b == 0x03 || b == 0x04:
+			// ctrl-c or ctrl-d
+			rw.Write([]byte("\r\n"))
+			return 0, false
+		case b == '\r' || b == '\n':
+			rw.Write([]byte("\r\n"))
+			selected = 1
+			if len(input) > 0 {
+				selected, _ = strconv.Atoi(string(input))
+			}
+			if selected >= min && selected <= count {
+				return selected, true
+			}
+			input = input[:0]
+			fmt.Fprintf(rw, "Invalid selection, enter a number between %d and %d: ", min, count)
+		}
+	}
+}
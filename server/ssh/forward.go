@@ -0,0 +1,354 @@
+package ssh
+
+import (
+	"context"
+	"docker4ssh/docker"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type DirectTCPIPPayload struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// handleDirectTCPIP handles local port forwarding (ssh -L).
+// Connections to localhost are redirected to the container
+func handleDirectTCPIP(channel ssh.NewChannel, user *User) {
+	var payload DirectTCPIPPayload
+	if err := ssh.Unmarshal(channel.ExtraData(), &payload); err != nil {
+		channel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+
+	// the container may have been stopped since it was set, its ip could
+	// then already belong to the container of someone else
+	container := user.Container()
+	if container == nil {
+		channel.Reject(ssh.Prohibited, "the container is not running, open a session first")
+		return
+	}
+	if running, err := container.Running(context.Background()); err != nil || !running {
+		channel.Reject(ssh.Prohibited, "the container is not running, open a session first")
+		return
+	}
+
+	switch container.Config().NetworkMode {
+	case docker.Off, docker.Isolate:
+		zap.S().Infof("Denied port forwarding to %s:%d for user %s due to the network mode of container %s", payload.DestAddr, payload.DestPort, user.ID, container.ContainerID)
+		channel.Reject(ssh.Prohibited, "port forwarding is not allowed for this container")
+		return
+	}
+
+	host, ok := forwardDestination(user, container, payload.DestAddr)
+	if !ok {
+		zap.S().Infof("Denied port forwarding to %s:%d for user %s", payload.DestAddr, payload.DestPort, user.ID)
+		channel.Reject(ssh.Prohibited, fmt.Sprintf("port forwarding to %s is not allowed", payload.DestAddr))
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(payload.DestPort))))
+	if err != nil {
+		channel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, requests, err := channel.Accept()
+	if err != nil {
+		conn.Close()
+		zap.S().Warnf("Failed to accept direct-tcpip channel for user %s", user.ID)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	zap.S().Debugf("Forwarding %s:%d (%s) for user %s", payload.DestAddr, payload.DestPort, conn.RemoteAddr().String(), user.ID)
+
+	pipe(ch, conn)
+}
+
+// forwardDestination returns the host which should be dialed for the
+// requested destination address. ok is false if the user is not allowed to
+// forward to the destination. Other destinations than the container are
+// dialed from the host, not from within the container network
+func forwardDestination(user *User, container *docker.SimpleContainer, destAddr string) (host string, ok bool) {
+	containerIP := container.Network.IP
+
+	switch destAddr {
+	case "localhost", "127.0.0.1", "::1", "":
+		if container.Config().NetworkMode == docker.None {
+			// the container shares the network with the host
+			return "127.0.0.1", true
+		} else if containerIP == "" {
+			// never fall back to the loopback of the host
+			return "", false
+		}
+		return containerIP, true
+	case containerIP:
+		return containerIP, containerIP != ""
+	}
+
+	return destAddr, user.Profile.ForwardAnyHost
+}
+
+// pipe copies data between a channel and a connection until both sides are done
+func pipe(channel ssh.Channel, conn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		io.Copy(conn, channel)
+		if closeWriter, ok := conn.(interface{ CloseWrite() error }); ok {
+			closeWriter.CloseWrite()
+		} else {
+			conn.Close()
+		}
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+		wg.Done()
+	}()
+
+	wg.Wait()
+	channel.Close()
+	conn.Close()
+}
+
+type TCPIPForwardPayload struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type TCPIPForwardResponse struct {
+	BindPort uint32
+}
+
+type ForwardedTCPIPPayload struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// remoteForwardTimeout is how long a remote forwarding request waits for the
+// container of the user to be started by a session
+const remoteForwardTimeout = 30 * time.Second
+
+func handleGlobalRequests(requests <-chan *ssh.Request, user *User) {
+	// the replies must be sent in the order of the requests, but a request
+	// which takes a while (e.g. remote forwarding, which waits for the
+	// container) must not hold up the handling of the following ones
+	previous := make(chan struct{})
+	close(previous)
+	for request := range requests {
+		done := make(chan struct{})
+		go func(request *ssh.Request, previous <-chan struct{}, done chan<- struct{}) {
+			defer close(done)
+
+			if request.Type == "cancel-tcpip-forward" {
+				// the forwarding to cancel may still be starting
+				<-previous
+			}
+			ok, response := handleGlobalRequest(request, user)
+			<-previous
+			if request.WantReply {
+				request.Reply(ok, response)
+			}
+		}(request, previous, done)
+		previous = done
+	}
+}
+
+// handleGlobalRequest handles a single global request and returns the reply
+func handleGlobalRequest(request *ssh.Request, user *User) (ok bool, response []byte) {
+	switch request.Type {
+	case "tcpip-forward":
+		var payload TCPIPForwardPayload
+		if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+			break
+		}
+		port, err := startRemoteForward(user, payload)
+		if err != nil {
+			zap.S().Infof("Failed to start remote port forwarding on port %d for user %s: %v", payload.BindPort, user.ID, err)
+			break
+		}
+		ok = true
+		if payload.BindPort == 0 {
+			// the client must be told which port was allocated
+			response = ssh.Marshal(TCPIPForwardResponse{BindPort: port})
+		}
+	case "cancel-tcpip-forward":
+		var payload TCPIPForwardPayload
+		if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+			break
+		}
+		ok = user.cancelForward(payload.BindAddr, payload.BindPort)
+	case RequestHostKeysProve:
+		var err error
+		if response, err = proveHostKeys(user, request.Payload); err != nil {
+			zap.S().Warnf("Failed to prove host keys for user %s: %v", user.ID, err)
+			break
+		}
+		ok = true
+	default:
+		zap.S().Debugf("New global request from user %s - Type: %s, Want Reply: %t", user.ID, request.Type, request.WantReply)
+	}
+
+	return ok, response
+}
+
+// gatewayHost returns the host address on which listeners must be opened so
+// that they can be reached from within the container
+func gatewayHost(container *docker.SimpleContainer) (string, error) {
+	var host string
+	switch container.Config().NetworkMode {
+	case docker.Off, docker.Isolate:
+		return "", fmt.Errorf("not allowed for network mode %s", container.Config().NetworkMode.Name())
+	case docker.None:
+		// the container shares the network with the host
+		host = "127.0.0.1"
+	default:
+		host = container.Network.Gateway
+	}
+	if host == "" {
+		return "", fmt.Errorf("container %s has no gateway", container.ContainerID)
+	}
+	return host, nil
+}
+
+// startRemoteForward handles remote port forwarding (ssh -R). The listener is
+// opened on the gateway address of the container network, so that it can be
+// reached from within the container, but only connections from the container
+// of the user are accepted. Returns the port of the listener
+func startRemoteForward(user *User, payload TCPIPForwardPayload) (uint32, error) {
+	if payload.BindPort != 0 && payload.BindPort < 1024 {
+		return 0, fmt.Errorf("privileged ports are not allowed")
+	}
+
+	// the client may request forwarding right after the authentication,
+	// before the container was started by a session. with 'ssh -N' no
+	// session is opened at all, so the wait is limited
+	container, ok := user.waitContainer(remoteForwardTimeout)
+	if !ok {
+		return 0, fmt.Errorf("no container was started within %s", remoteForwardTimeout)
+	}
+
+	host, err := gatewayHost(container)
+	if err != nil {
+		return 0, err
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(payload.BindPort))))
+	if err != nil {
+		return 0, err
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+
+	user.forwardsMutex.Lock()
+	select {
+	case <-user.done:
+		// the forwardings were already closed with the connection
+		user.forwardsMutex.Unlock()
+		listener.Close()
+		return 0, fmt.Errorf("the connection was closed")
+	default:
+	}
+	user.forwards[net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(port)))] = listener
+	user.forwardsMutex.Unlock()
+
+	zap.S().Infof("Started remote port forwarding on %s for user %s", listener.Addr().String(), user.ID)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !remoteForwardAllowed(user, conn.RemoteAddr()) {
+				zap.S().Infof("Rejected connection from %s to remote port forwarding of user %s", conn.RemoteAddr().String(), user.ID)
+				conn.Close()
+				continue
+			}
+			go forwardRemoteConn(user, conn, payload.BindAddr, port)
+		}
+	}()
+
+	return port, nil
+}
+
+// remoteForwardAllowed returns if a connection from addr may use the remote
+// port forwarding of the user. The gateway is shared by all containers of the
+// network, so only the container of the user is allowed to connect
+func remoteForwardAllowed(user *User, addr net.Addr) bool {
+	container := user.Container()
+	if container == nil {
+		return false
+	}
+	ip := remoteIP(addr)
+	if container.Config().NetworkMode == docker.None {
+		// the container shares the network with the host
+		return net.ParseIP(ip).IsLoopback()
+	}
+	return container.Network.IP != "" && ip == container.Network.IP
+}
+
+// forwardRemoteConn relays a connection, which was accepted by a remote
+// forwarding listener, to the client
+func forwardRemoteConn(user *User, conn net.Conn, bindAddr string, bindPort uint32) {
+	originAddr, rawOriginPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	originPort, _ := strconv.Atoi(rawOriginPort)
+
+	ch, requests, err := user.OpenChannel("forwarded-tcpip", ssh.Marshal(ForwardedTCPIPPayload{
+		DestAddr:   bindAddr,
+		DestPort:   bindPort,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	}))
+	if err != nil {
+		zap.S().Debugf("Client of user %s rejected forwarded connection: %v", user.ID, err)
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	pipe(ch, conn)
+}
+
+// cancelForward stops a remote port forwarding
+func (u *User) cancelForward(bindAddr string, bindPort uint32) bool {
+	u.forwardsMutex.Lock()
+	defer u.forwardsMutex.Unlock()
+
+	key := net.JoinHostPort(bindAddr, strconv.Itoa(int(bindPort)))
+	listener, ok := u.forwards[key]
+	if !ok {
+		return false
+	}
+	listener.Close()
+	delete(u.forwards, key)
+
+	zap.S().Infof("Stopped remote port forwarding on %s for user %s", listener.Addr().String(), u.ID)
+	return true
+}
+
+// closeForwards stops all remote port forwardings
+func (u *User) closeForwards() {
+	u.forwardsMutex.Lock()
+	defer u.forwardsMutex.Unlock()
+
+	for key, listener := range u.forwards {
+		listener.Close()
+		delete(u.forwards, key)
+	}
+}
@@ -2,6 +2,7 @@ package ssh
 
 import (
 	"docker4ssh/docker"
+	"docker4ssh/terminal"
 	"fmt"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
@@ -12,6 +13,12 @@ type RequestType string
 const (
 	RequestPtyReq       RequestType = "pty-req"
 	RequestWindowChange RequestType = "window-change"
+	RequestShell        RequestType = "shell"
+	RequestExec         RequestType = "exec"
+	RequestSubsystem    RequestType = "subsystem"
+	RequestAuthAgent    RequestType = "auth-agent-req@openssh.com"
+	RequestEnv          RequestType = "env"
+	RequestX11          RequestType = "x11-req"
 )
 
 type PtyReqPayload struct {
@@ -23,6 +30,41 @@ type PtyReqPayload struct {
 	Modes []byte
 }
 
+type WindowChangePayload struct {
+	Width, Height           uint32
+	PixelWidth, PixelHeight uint32
+}
+
+type X11ReqPayload struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+type EnvPayload struct {
+	Name, Value string
+}
+
+type ExecPayload struct {
+	Command string
+}
+
+type SubsystemPayload struct {
+	Name string
+}
+
+type ExitStatusPayload struct {
+	Status uint32
+}
+
+type ExitSignalPayload struct {
+	Signal       string
+	CoreDumped   bool
+	ErrorMessage string
+	LanguageTag  string
+}
+
 func handleChannels(chans <-chan ssh.NewChannel, client *docker.Client, user *User) {
 	for channel := range chans {
 		go handleChannel(channel, client, user)
@@ -30,32 +72,81 @@ func handleChannels(chans <-chan ssh.NewChannel, client *docker.Client, user *Us
 }
 
 func handleChannel(channel ssh.NewChannel, client *docker.Client, user *User) {
-	if t := channel.ChannelType(); t != "session" {
+	switch t := channel.ChannelType(); t {
+	case "session":
+		handleSession(channel, client, user)
+	case "direct-tcpip":
+		handleDirectTCPIP(channel, user)
+	default:
 		channel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
-		return
 	}
+}
 
+func handleSession(channel ssh.NewChannel, client *docker.Client, user *User) {
 	conn, requests, err := channel.Accept()
 	if err != nil {
 		zap.S().Warnf("Failed to accept channel for user %s", user.ID)
 		return
 	}
 	defer conn.Close()
-	user.Terminal.ReadWriter = conn
+
+	// every session has its own terminal, but shares the container with
+	// the other sessions of the connection
+	session := &Session{
+		User: user,
+		Terminal: &terminal.Terminal{
+			ReadWriter: conn,
+			Stderr:     conn.Stderr(),
+			Closed:     make(chan struct{}),
+			User:       user.User(),
+		},
+	}
 
 	// handle all other request besides the normal user input.
-	// currently, only 'pty-req' is implemented which determines a terminal size change
-	go handleRequest(requests, user)
+	// the session starts when a 'shell', 'exec' or 'subsystem' request was received
+	start := make(chan bool, 1)
+	go handleRequest(requests, session, start)
+
+	if ok := <-start; !ok {
+		zap.S().Debugf("Channel for user %s closed before a shell or command was requested", user.ID)
+		return
+	}
 
 	// this handles the actual user terminal connection.
 	// blocks until the session has finished
-	connection(client, user)
+	exitStatus := connection(client, session)
+	if exitStatus != nil {
+		sendExitStatus(conn, exitStatus)
+	}
 
 	zap.S().Debugf("Session for user %s ended", user.ID)
 }
 
-func handleRequest(requests <-chan *ssh.Request, user *User) {
+// sendExitStatus tells the client how the process of the session has
+// finished. Either exit-signal or exit-status is sent (RFC 4254 section
+// 6.10). Must be sent before the channel gets closed
+func sendExitStatus(channel ssh.Channel, exitStatus *docker.ExitStatus) {
+	var err error
+	if exitStatus.Signal != "" {
+		_, err = channel.SendRequest("exit-signal", false, ssh.Marshal(ExitSignalPayload{
+			Signal: exitStatus.Signal,
+		}))
+	} else {
+		_, err = channel.SendRequest("exit-status", false, ssh.Marshal(ExitStatusPayload{
+			Status: uint32(exitStatus.Code),
+		}))
+	}
+	if err != nil {
+		zap.S().Warnf("Failed to send exit status: %v", err)
+	}
+}
+
+func handleRequest(requests <-chan *ssh.Request, session *Session, start chan<- bool) {
+	var started bool
+
 	for request := range requests {
+		ok := true
+
 		switch RequestType(request.Type) {
 		case RequestPtyReq:
 			// this could spam the logs when the user resizes his window constantly
@@ -64,16 +155,80 @@ func handleRequest(requests <-chan *ssh.Request, user *User) {
 			var ptyReq PtyReqPayload
 			ssh.Unmarshal(request.Payload, &ptyReq)
 
-			user.Terminal.Width = ptyReq.Width
-			user.Terminal.Height = ptyReq.Height
+			session.Terminal.Pty = true
+			session.Terminal.Term = ptyReq.Term
+			session.Terminal.Resize(ptyReq.Width, ptyReq.Height)
+		case RequestAuthAgent:
+			session.Terminal.AgentForwarding = true
+		case RequestX11:
+			var x11Req X11ReqPayload
+			if err := ssh.Unmarshal(request.Payload, &x11Req); err != nil || started {
+				ok = false
+				break
+			}
+			session.Terminal.X11 = &terminal.X11{
+				SingleConnection: x11Req.SingleConnection,
+				AuthProtocol:     x11Req.AuthProtocol,
+				AuthCookie:       x11Req.AuthCookie,
+				Screen:           x11Req.ScreenNumber,
+			}
+		case RequestEnv:
+			var envReq EnvPayload
+			if err := ssh.Unmarshal(request.Payload, &envReq); err != nil || started || !session.Profile.AcceptsEnv(envReq.Name) {
+				// variables sent after the shell has started can't be applied anymore
+				ok = false
+				break
+			}
+			session.Terminal.Env = append(session.Terminal.Env, envReq.Name+"="+envReq.Value)
+			zap.S().Debugf("User %s set environment variable %s", session.ID, envReq.Name)
 		case RequestWindowChange:
-			// prevent from logging
+			// not logged for the same reason as 'pty-req'
+			var windowChange WindowChangePayload
+			ssh.Unmarshal(request.Payload, &windowChange)
+
+			session.Terminal.Resize(windowChange.Width, windowChange.Height)
+		case RequestShell, RequestExec, RequestSubsystem:
+			if started {
+				// only one shell, command or subsystem can be run per channel
+				ok = false
+				break
+			}
+			switch RequestType(request.Type) {
+			case RequestExec:
+				var execReq ExecPayload
+				if err := ssh.Unmarshal(request.Payload, &execReq); err != nil {
+					ok = false
+					break
+				}
+				session.Terminal.Command = execReq.Command
+				zap.S().Debugf("User %s requested command '%s'", session.ID, execReq.Command)
+			case RequestSubsystem:
+				var subsystemReq SubsystemPayload
+				if err := ssh.Unmarshal(request.Payload, &subsystemReq); err != nil || subsystemReq.Name != "sftp" {
+					zap.S().Debugf("User %s requested unsupported subsystem '%s'", session.ID, subsystemReq.Name)
+					ok = false
+					break
+				}
+				session.Terminal.Subsystem = subsystemReq.Name
+				zap.S().Debugf("User %s requested subsystem '%s'", session.ID, subsystemReq.Name)
+			}
+			if ok {
+				started = true
+				start <- true
+			}
 		default:
-			zap.S().Debugf("New request from user %s - Type: %s, Want Reply: %t, Payload: '%s'", user.ID, request.Type, request.WantReply, request.Payload)
+			zap.S().Debugf("New request from user %s - Type: %s, Want Reply: %t, Payload: '%s'", session.ID, request.Type, request.WantReply, request.Payload)
 		}
 
 		if request.WantReply {
-			request.Reply(true, nil)
+			request.Reply(ok, nil)
 		}
 	}
+
+	// the requests end when the channel was closed
+	close(session.Terminal.Closed)
+
+	if !started {
+		start <- false
+	}
 }
@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	c "docker4ssh/config"
+	"encoding/pem"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+)
+
+const (
+	RequestHostKeys      = "hostkeys-00@openssh.com"
+	RequestHostKeysProve = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeys contains all host keys of the server. Only the first key of every
+// type is used for the key exchange, but all of them are announced to the
+// clients
+var hostKeys []ssh.Signer
+
+type HostKeyPayload struct {
+	Key  []byte
+	Rest []byte `ssh:"rest"`
+}
+
+type HostKeyProveData struct {
+	Request   string
+	SessionID []byte
+	Key       []byte
+}
+
+type HostKeyProveSignature struct {
+	Signature []byte
+}
+
+// loadHostKeys loads all host keys of the config. If no keyfile is configured,
+// missing host keys are generated and persisted
+func loadHostKeys(config *c.Config) ([]ssh.Signer, error) {
+	keyfiles, generated := config.HostKeyfiles()
+	passphrase := []byte(config.SSH.Passphrase)
+
+	var signers []ssh.Signer
+	for i, keyfile := range keyfiles {
+		if generated {
+			if _, err := os.Stat(keyfile); os.IsNotExist(err) {
+				if err = generateHostKey(c.GeneratedHostKeyTypes[i], keyfile, passphrase); err != nil {
+					return nil, fmt.Errorf("failed to generate %s host key: %v", c.GeneratedHostKeyTypes[i], err)
+				}
+				zap.S().Infof("Generated %s host key %s", c.GeneratedHostKeyTypes[i], keyfile)
+			}
+		}
+
+		signer, err := parseSSHPrivateKey(keyfile, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load host key %s: %v", keyfile, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// generateHostKey generates a new private key of the given type and writes it
+// in the openssh format to path
+func generateHostKey(keyType, path string, passphrase []byte) error {
+	var key crypto.PrivateKey
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return fmt.Errorf("unknown key type %s", keyType)
+	}
+	if err != nil {
+		return err
+	}
+
+	var block *pem.Block
+	if len(passphrase) == 0 {
+		block, err = ssh.MarshalPrivateKey(key, "docker4ssh")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "docker4ssh", passphrase)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// announceHostKeys sends all host keys to the client. Clients with
+// 'UpdateHostKeys' enabled learn new keys this way before they are used for
+// the key exchange, which makes host key rotation possible
+func announceHostKeys(user *User) {
+	var payload []byte
+	for _, hostKey := range hostKeys {
+		payload = append(payload, ssh.Marshal(HostKeyPayload{Key: hostKey.PublicKey().Marshal()})...)
+	}
+
+	if _, _, err := user.SendRequest(RequestHostKeys, false, payload); err != nil {
+		zap.S().Debugf("Failed to announce host keys to user %s: %v", user.ID, err)
+	}
+}
+
+// proveHostKeys signs every host key which the client requested to prove
+// that the server owns the private keys
+func proveHostKeys(user *User, payload []byte) ([]byte, error) {
+	var response []byte
+	for len(payload) > 0 {
+		var hostKeyPayload HostKeyPayload
+		if err := ssh.Unmarshal(payload, &hostKeyPayload); err != nil {
+			return nil, err
+		}
+		payload = hostKeyPayload.Rest
+
+		var signer ssh.Signer
+		for _, hostKey := range hostKeys {
+			if bytes.Equal(hostKey.PublicKey().Marshal(), hostKeyPayload.Key) {
+				signer = hostKey
+				break
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("requested to prove an unknown host key")
+		}
+
+		data := ssh.Marshal(HostKeyProveData{
+			Request:   RequestHostKeysProve,
+			SessionID: user.SessionID(),
+			Key:       hostKeyPayload.Key,
+		})
+
+		var signature *ssh.Signature
+		var err error
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			// openssh expects rsa keys to be proven with a sha2 signature
+			signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			signature, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		response = append(response, ssh.Marshal(HostKeyProveSignature{Signature: ssh.Marshal(signature)})...)
+	}
+	return response, nil
+}
@@ -0,0 +1,207 @@
+package ssh
+
+import (
+	"docker4ssh/database"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureWindow = 10 * time.Minute
+	defaultBanDuration   = time.Hour
+	// handshakeTimeout is the time a client has to authenticate
+	handshakeTimeout = 2 * time.Minute
+)
+
+// limiter protects the server against brute-force attacks. It counts the
+// authentication failures of every ip across connections, bans ips which
+// exceed the maximum and caps the concurrent unauthenticated connections per
+// ip and of the whole server
+type limiter struct {
+	// maxAuthFailures is the number of failures within failureWindow after
+	// which an ip gets banned. 0 disables banning
+	maxAuthFailures int
+	failureWindow   time.Duration
+	banDuration     time.Duration
+	// maxUnauthenticated is the number of concurrent unauthenticated
+	// connections per ip. 0 means unlimited
+	maxUnauthenticated int
+	// maxHandshakes is the number of concurrent unauthenticated connections
+	// of all ips. 0 means unlimited
+	maxHandshakes int
+
+	mutex           sync.Mutex
+	failures        map[string][]time.Time
+	lastSweep       time.Time
+	unauthenticated map[string]int
+	handshakes      int
+	// rejectedKeys contains the remote addresses of the unauthenticated
+	// connections which have offered an unknown public key
+	rejectedKeys map[string]bool
+}
+
+var connLimiter = &limiter{
+	failures:        map[string][]time.Time{},
+	unauthenticated: map[string]int{},
+	rejectedKeys:    map[string]bool{},
+}
+
+// configure sets the limits. Blank durations fall back to the defaults
+func (l *limiter) configure(maxAuthFailures int, failureWindow, banDuration string, maxUnauthenticated, maxHandshakes int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.maxAuthFailures = maxAuthFailures
+	l.maxUnauthenticated = maxUnauthenticated
+	l.maxHandshakes = maxHandshakes
+
+	l.failureWindow = defaultFailureWindow
+	if failureWindow != "" {
+		duration, err := time.ParseDuration(failureWindow)
+		if err != nil {
+			return fmt.Errorf("failed to parse failure window: %v", err)
+		}
+		l.failureWindow = duration
+	}
+	l.banDuration = defaultBanDuration
+	if banDuration != "" {
+		duration, err := time.ParseDuration(banDuration)
+		if err != nil {
+			return fmt.Errorf("failed to parse ban duration: %v", err)
+		}
+		l.banDuration = duration
+	}
+	return nil
+}
+
+// accept checks if a new connection from the ip is allowed. If so, the
+// connection counts as unauthenticated until authenticated is called
+func (l *limiter) accept(ip string) error {
+	if ban, ok := database.GetDatabase().GetBan(ip); ok {
+		return fmt.Errorf("banned until %s (%s)", ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxHandshakes > 0 && l.handshakes >= l.maxHandshakes {
+		return fmt.Errorf("too many unauthenticated connections on the server")
+	}
+	if l.maxUnauthenticated > 0 && l.unauthenticated[ip] >= l.maxUnauthenticated {
+		return fmt.Errorf("too many unauthenticated connections")
+	}
+	l.handshakes++
+	l.unauthenticated[ip]++
+	return nil
+}
+
+// authenticated must be called when a connection which was accepted has
+// finished its authentication. If it failed after unknown public keys were
+// offered, this counts as one failed authentication
+func (l *limiter) authenticated(addr net.Addr, success bool) {
+	ip := remoteIP(addr)
+
+	l.mutex.Lock()
+	l.handshakes--
+	if l.unauthenticated[ip]--; l.unauthenticated[ip] <= 0 {
+		delete(l.unauthenticated, ip)
+	}
+	rejectedKeys := l.rejectedKeys[addr.String()]
+	delete(l.rejectedKeys, addr.String())
+	l.mutex.Unlock()
+
+	if rejectedKeys && !success {
+		l.fail(ip)
+	}
+}
+
+// authLog is used as ssh.ServerConfig.AuthLogCallback and counts every failed
+// password or keyboard-interactive authentication attempt.
+// Rejected public keys are not counted one by one since clients query every
+// key of their agent until one is accepted, the connection counts as one
+// failure if it does not authenticate at all (see authenticated)
+func (l *limiter) authLog(conn ssh.ConnMetadata, method string, err error) {
+	var partialSuccessError *ssh.PartialSuccessError
+	// 'none' is used by clients to get the available methods
+	if err == nil || method == "none" || errors.As(err, &partialSuccessError) {
+		return
+	}
+	if method == "publickey" {
+		l.mutex.Lock()
+		l.rejectedKeys[conn.RemoteAddr().String()] = true
+		l.mutex.Unlock()
+		return
+	}
+	l.fail(remoteIP(conn.RemoteAddr()))
+}
+
+// fail records a failed authentication of the ip and bans it if it exceeded
+// the maximum failures
+func (l *limiter) fail(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxAuthFailures <= 0 {
+		return
+	}
+
+	now := time.Now()
+	l.sweep(now)
+
+	failures := append(l.failures[ip], now)
+	// only failures within the window count
+	for len(failures) > 0 && now.Sub(failures[0]) > l.failureWindow {
+		failures = failures[1:]
+	}
+
+	if len(failures) < l.maxAuthFailures {
+		l.failures[ip] = failures
+		return
+	}
+	delete(l.failures, ip)
+
+	ban := database.Ban{
+		IP:     ip,
+		Until:  now.Add(l.banDuration),
+		Reason: fmt.Sprintf("%d failed authentications within %s", len(failures), l.failureWindow),
+	}
+	if err := database.GetDatabase().SetBan(ban); err != nil {
+		zap.S().Errorf("Failed to ban %s: %v", ip, err)
+		return
+	}
+	zap.S().Warnf("Banned %s until %s: %s", ip, ban.Until.Format(time.RFC3339), ban.Reason)
+}
+
+// sweep removes the failures of all ips whose last failure is outside the
+// window. Otherwise ips which never reach the maximum, e.g. when an attacker
+// rotates them, would be kept forever. It runs at most once per window and
+// must be called with the mutex held
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.failureWindow {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, failures := range l.failures {
+		if now.Sub(failures[len(failures)-1]) > l.failureWindow {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+// remoteIP returns the ip of addr without the port
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
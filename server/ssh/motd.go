@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"bytes"
+	c "docker4ssh/config"
+	"docker4ssh/docker"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"time"
+)
+
+// banner returns the banner which is sent to the client before it
+// authenticates. Since the user is not authenticated yet, the profile is
+// matched by the username only
+func banner(config *c.Config, conn ssh.ConnMetadata) string {
+	text := config.Profile.Default.Banner
+	if profile, ok := profiles.MatchUsername(conn.User(), conn.RemoteAddr()); ok {
+		text = profile.Banner
+	} else if config.Profile.Dynamic.Enable {
+		text = dynamicProfile.Banner
+	}
+
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
+
+// renderMotd renders the motd template of the profile of the session
+func renderMotd(session *Session, container *docker.InteractiveContainer) ([]byte, error) {
+	motd := session.Profile.Motd
+	if motd == nil {
+		var err error
+		if motd, err = c.ParseMotd(""); err != nil {
+			return nil, err
+		}
+	}
+
+	config := container.Config()
+	data := c.MotdData{
+		ContainerID:     container.ContainerID,
+		FullContainerID: container.FullContainerID,
+		Image:           container.Image.Ref(),
+		IP:              container.Network.IP,
+		NetworkMode:     config.NetworkMode.Name(),
+		Configurable:    config.Configurable,
+		RunLevel:        config.RunLevel.Name(),
+		ExitAfter:       config.ExitAfter,
+		KeepOnExit:      config.KeepOnExit,
+		User:            session.User.User(),
+		Profile:         session.Profile.Name(),
+		Sessions:        container.TerminalCount() + 1,
+	}
+	if session.Profile.MaxSessionDuration > 0 {
+		data.Expires = time.Now().Add(session.Profile.MaxSessionDuration)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := motd.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	// the terminal is in raw mode
+	out := bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n")), nil
+}
@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"docker4ssh/database"
+	"docker4ssh/docker"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"text/tabwriter"
+)
+
+// selectContainer lets the user choose one of the saved containers the
+// credentials match or to create a new container from the fresh profile.
+// The profile of the user gets replaced by the one of the selection. Returns
+// false if nothing was selected
+func selectContainer(ctx context.Context, client *docker.Client, session *Session) bool {
+	// only the first session of the connection selects the container
+	candidates, fresh := session.candidates, session.freshProfile
+	session.candidates, session.freshProfile = nil, nil
+
+	if !session.Terminal.Pty {
+		// a menu cannot be shown without a pty, so the first container is used
+		return true
+	}
+
+	db := database.GetDatabase()
+
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	for i, containerID := range candidates {
+		image, status := "unknown", "removed"
+		if inspect, err := client.Client.ContainerInspect(ctx, containerID); err == nil {
+			image, status = inspect.Config.Image, inspect.State.Status
+		}
+		lastLogin := "never"
+		if at, ok := db.GetLastLogin(containerID); ok {
+			lastLogin = at.Format("2006-01-02 15:04:05")
+		}
+		shortID := containerID
+		if len(shortID) > 12 {
+			shortID = shortID[:12]
+		}
+		fmt.Fprintf(w, "  [%d] %s\t%s\t%s\tlast login %s\n", i+1, shortID, image, status, lastLogin)
+	}
+	w.Flush()
+
+	fmt.Fprint(session.Terminal, "Your login matches multiple containers:\r\n")
+	session.Terminal.Write(bytes.ReplaceAll(buf.Bytes(), []byte("\n"), []byte("\r\n")))
+	if fresh != nil {
+		if fresh.Image != "" {
+			fmt.Fprintf(session.Terminal, "  [0] create a new container from %s\r\n", fresh.Image)
+		} else {
+			fmt.Fprintf(session.Terminal, "  [0] create a new container from profile %s\r\n", fresh.Name())
+		}
+	}
+	fmt.Fprint(session.Terminal, "Select a container [1]: ")
+
+	selected, ok := readSelection(session.Terminal, len(candidates), fresh != nil)
+	if !ok {
+		fmt.Fprint(session.Terminal, "No container selected\r\n")
+		return false
+	}
+	if selected == 0 {
+		zap.S().Infof("User %s creates a new container from profile %s instead of using one of %s", session.ID, fresh.Name(), strings.Join(candidates, ", "))
+		session.Profile = fresh
+		return true
+	}
+
+	profile, _ := resolveProfile("", "", candidates[selected-1])
+	if profile == nil {
+		fmt.Fprint(session.Terminal, "Failed to get the selected container\r\n")
+		return false
+	}
+	zap.S().Infof("User %s selected container %s", session.ID, candidates[selected-1])
+	session.Profile = profile
+	return true
+}
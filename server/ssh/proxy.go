@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtocolV2Signature is the fixed start of every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose remote address was sent by a proxy via the
+// PROXY protocol
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	return pc.reader.Read(p)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remoteAddr
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header from conn if it
+// comes from a trusted proxy and returns a connection with the client address
+// of the header as remote address. Connections from other sources are
+// returned unchanged
+func readProxyHeader(conn net.Conn, trustedProxies []*net.IPNet) (net.Conn, error) {
+	ip := net.ParseIP(remoteIP(conn.RemoteAddr()))
+	var trusted bool
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return conn, nil
+	}
+
+	reader := bufio.NewReader(conn)
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteAddr net.Addr
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		remoteAddr, err = readProxyHeaderV2(reader)
+	} else if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		remoteAddr, err = readProxyHeaderV1(reader)
+	} else {
+		return nil, fmt.Errorf("trusted proxy %s sent no proxy protocol header", conn.RemoteAddr().String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol header from %s: %v", conn.RemoteAddr().String(), err)
+	}
+	if remoteAddr == nil {
+		// the proxy connected itself (e.g. for a health check)
+		remoteAddr = conn.RemoteAddr()
+	}
+
+	return &proxyConn{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: remoteAddr,
+	}, nil
+}
+
+// readProxyHeaderV1 reads a human-readable header like
+// 'PROXY TCP4 192.168.0.1 192.168.0.11 56324 2222\r\n'. The returned address
+// is nil if the protocol is 'UNKNOWN'
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	// the header is at most 107 bytes long
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("header is not terminated")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 {
+		return nil, fmt.Errorf("header has %d instead of 6 fields", len(fields))
+	}
+
+	switch fields[1] {
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown protocol %s", fields[1])
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header. The returned address is nil if the
+// command is 'LOCAL' or the address family is not tcp over ipv4 or ipv6
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unknown command %d", versionCommand&0x0f)
+	}
+
+	switch family {
+	case 0x11:
+		// tcp over ipv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		// tcp over ipv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
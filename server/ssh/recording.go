@@ -0,0 +1,45 @@
+package ssh
+
+import (
+	c "docker4ssh/config"
+	"docker4ssh/docker"
+	"docker4ssh/terminal"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordingTimeFormat is the format of the time in the names of recording
+// files
+const recordingTimeFormat = "20060102-150405.000000"
+
+// startRecording starts recording the session into the recording directory
+// of the container. The returned recorder is nil if recording is disabled
+func startRecording(session *Session, container *docker.InteractiveContainer) (*terminal.Recorder, error) {
+	config := c.GetConfig()
+	if config.Recording.Dir == "" {
+		return nil, nil
+	}
+
+	dir := filepath.Join(config.Recording.Dir, container.ContainerID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	file := filepath.Join(dir, fmt.Sprintf("%s-%s.cast", started.Format(recordingTimeFormat), session.ID))
+
+	env := map[string]string{}
+	if session.Terminal.Term != "" {
+		env["TERM"] = session.Terminal.Term
+	}
+	width, height := session.Terminal.Size()
+	return terminal.NewRecorder(file, terminal.RecordingHeader{
+		Width:     width,
+		Height:    height,
+		Timestamp: started.Unix(),
+		Title:     fmt.Sprintf("%s@%s (%s)", session.User.User(), container.ContainerID, session.Profile.Name()),
+		Env:       env,
+	}, config.Recording.Input)
+}
@@ -0,0 +1,220 @@
+package ssh
+
+import (
+	"bytes"
+	"docker4ssh/docker"
+	"docker4ssh/terminal"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"sync"
+)
+
+const (
+	// shadowViewerPrefix is the username prefix to watch the shell of a
+	// container, e.g. 'watch+a1b2c3d4e5f6'
+	shadowViewerPrefix = "watch+"
+	// shadowCopilotPrefix is the username prefix to watch the shell of a
+	// container and send input to it
+	shadowCopilotPrefix = "copilot+"
+)
+
+// shadowKey is a public key which is allowed to shadow sessions
+type shadowKey struct {
+	key     ssh.PublicKey
+	name    string
+	copilot bool
+}
+
+var shadowKeys []shadowKey
+
+// loadShadowKeys parses the viewer and copilot keys. The comment of a key is
+// used as name which is shown to the users who are watched
+func loadShadowKeys(viewerKeys, copilotKeys []string) ([]shadowKey, error) {
+	var keys []shadowKey
+	for _, rawKeys := range []struct {
+		keys    []string
+		copilot bool
+	}{
+		{viewerKeys, false},
+		{copilotKeys, true},
+	} {
+		for _, rawKey := range rawKeys.keys {
+			key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(rawKey))
+			if err != nil {
+				return nil, fmt.Errorf("invalid shadow key '%s': %v", rawKey, err)
+			}
+			if comment == "" {
+				comment = ssh.FingerprintSHA256(key)
+			}
+			keys = append(keys, shadowKey{key: key, name: comment, copilot: rawKeys.copilot})
+		}
+	}
+	return keys, nil
+}
+
+// parseShadowUser checks if the user has the form of a shadow login
+func parseShadowUser(user string) (containerID string, copilot bool, ok bool) {
+	if containerID = strings.TrimPrefix(user, shadowViewerPrefix); containerID != user {
+		return containerID, false, containerID != ""
+	} else if containerID = strings.TrimPrefix(user, shadowCopilotPrefix); containerID != user {
+		return containerID, true, containerID != ""
+	}
+	return "", false, false
+}
+
+// authenticateShadow checks if the key is allowed to shadow in the mode of
+// the username
+func authenticateShadow(conn ssh.ConnMetadata, key ssh.PublicKey, containerID string, copilot bool) (*ssh.Permissions, error) {
+	for _, shadowKey := range shadowKeys {
+		if !bytes.Equal(shadowKey.key.Marshal(), key.Marshal()) || (copilot && !shadowKey.copilot) {
+			continue
+		}
+		mode := "viewer"
+		if copilot {
+			mode = "copilot"
+		}
+		return &ssh.Permissions{
+			CriticalOptions: map[string]string{
+				"shadow":     containerID,
+				"shadowMode": mode,
+				"shadowName": shadowKey.name,
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("%s tried to shadow container %s with user %s but offered an unauthorized public key (%s)", conn.RemoteAddr().String(), containerID, conn.User(), ssh.FingerprintSHA256(key))
+}
+
+// serveShadow serves every session of a shadow connection. Shadow connections
+// have no container of their own, they only watch the shell of another user
+func serveShadow(conn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	containerID := conn.Permissions.CriticalOptions["shadow"]
+	copilot := conn.Permissions.CriticalOptions["shadowMode"] == "copilot"
+	name := conn.Permissions.CriticalOptions["shadowName"]
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "shadow connections only support sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			zap.S().Warnf("Failed to accept shadow session of %s: %v", name, err)
+			continue
+		}
+		go serveShadowSession(channel, requests, containerID, name, copilot)
+	}
+}
+
+func serveShadowSession(channel ssh.Channel, requests <-chan *ssh.Request, containerID, name string, copilot bool) {
+	defer channel.Close()
+
+	start := make(chan struct{})
+	var startOnce sync.Once
+	go func() {
+		for req := range requests {
+			switch RequestType(req.Type) {
+			case RequestPtyReq, RequestWindowChange, RequestEnv:
+				// the size of the watched terminal can't be changed
+				req.Reply(true, nil)
+			case RequestShell:
+				req.Reply(true, nil)
+				startOnce.Do(func() { close(start) })
+			default:
+				req.Reply(false, nil)
+			}
+		}
+		// the channel was closed before the shell request
+		startOnce.Do(func() { close(start) })
+	}()
+	<-start
+
+	term := selectShadowTerminal(channel, containerID)
+	if term == nil {
+		sendExitStatus(channel, &docker.ExitStatus{Code: 1})
+		return
+	}
+
+	mode, action := "read-only", "watching"
+	if copilot {
+		mode, action = "with input", "co-driving"
+	}
+	shadow := term.AddShadow(name, copilot, channel)
+	defer term.RemoveShadow(shadow)
+
+	zap.S().Infof("%s started %s the shell of %s in container %s", name, action, term.User, containerID)
+	fmt.Fprintf(term.ErrorWriter(), "\r\n[docker4ssh] %s is now %s this session\r\n", name, action)
+	if copilot {
+		fmt.Fprintf(channel, "Shadowing the shell of %s (%s), disconnect to leave\r\n", term.User, mode)
+	} else {
+		fmt.Fprintf(channel, "Shadowing the shell of %s (%s), press ctrl-c to leave\r\n", term.User, mode)
+	}
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := channel.Read(buf)
+			if err != nil {
+				term.RemoveShadow(shadow)
+				return
+			}
+			if copilot {
+				if _, err = term.WriteInput(buf[:n]); err != nil {
+					term.RemoveShadow(shadow)
+					return
+				}
+			} else if bytes.IndexByte(buf[:n], 0x03) != -1 || bytes.IndexByte(buf[:n], 0x04) != -1 {
+				// ctrl-c or ctrl-d
+				term.RemoveShadow(shadow)
+				return
+			}
+		}
+	}()
+
+	<-shadow.Done()
+	fmt.Fprintf(term.ErrorWriter(), "\r\n[docker4ssh] %s stopped %s this session\r\n", name, action)
+	fmt.Fprint(channel, "\r\nStopped shadowing\r\n")
+	zap.S().Infof("%s stopped %s the shell of %s in container %s", name, action, term.User, containerID)
+	sendExitStatus(channel, &docker.ExitStatus{Code: 0})
+}
+
+// selectShadowTerminal returns the shell of the container which should be
+// shadowed. If the container has multiple shells, the shadow has to choose one
+func selectShadowTerminal(channel ssh.Channel, containerID string) *terminal.Terminal {
+	var terminals []*terminal.Terminal
+	for _, container := range containers() {
+		if container.ContainerID != containerID && !strings.HasPrefix(container.FullContainerID, containerID) {
+			continue
+		}
+		for _, term := range container.Terminals() {
+			if term.Pty && term.Subsystem == "" {
+				terminals = append(terminals, term)
+			}
+		}
+	}
+
+	switch len(terminals) {
+	case 0:
+		fmt.Fprintf(channel, "Container %s has no running shell\r\n", containerID)
+		return nil
+	case 1:
+		return terminals[0]
+	}
+
+	fmt.Fprintf(channel, "Container %s has multiple running shells:\r\n", containerID)
+	for i, term := range terminals {
+		command := term.Command
+		if command == "" {
+			command = "shell"
+		}
+		fmt.Fprintf(channel, "  [%d] %s (%s)\r\n", i+1, term.User, command)
+	}
+	fmt.Fprint(channel, "Select a shell [1]: ")
+
+	selected, ok := readSelection(channel, len(terminals), false)
+	if !ok {
+		return nil
+	}
+	return terminals[selected-1]
+}
@@ -14,10 +14,13 @@ import (
 	"net"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	users = make([]*User, 0)
+	users      = make([]*User, 0)
+	usersMutex sync.RWMutex
 
 	profiles       c.Profiles
 	dynamicProfile c.Profile
@@ -26,16 +29,96 @@ var (
 type User struct {
 	*ssh.ServerConn
 
-	ID        string
-	IP        string
-	Profile   *c.Profile
-	Terminal  *terminal.Terminal
-	Container *docker.SimpleContainer
+	ID      string
+	IP      string
+	Profile *c.Profile
+
+	// simpleContainer is the running container of the user, it must only be
+	// accessed via Container and setContainer. It has its own mutex since
+	// containerMutex is held while the user selects a container
+	simpleContainer      *docker.SimpleContainer
+	simpleContainerMutex sync.RWMutex
+
+	// containerReady gets closed when the container is set the first time
+	containerReady chan struct{}
+	containerOnce  sync.Once
+
+	// containerMutex guards container and sessions, the container is shared
+	// between all sessions of the connection
+	containerMutex sync.Mutex
+	container      *docker.InteractiveContainer
+	sessions       int
+
+	// done gets closed when the ssh connection was closed
+	done chan struct{}
+
+	// candidates are the saved containers the credentials of the user match.
+	// If there are multiple, the user selects one of them when the first
+	// session is opened. freshProfile is set if the user may create a new
+	// container from it instead
+	candidates   []string
+	freshProfile *c.Profile
+
+	// forwards contains all listeners of remote port forwarding (ssh -R)
+	forwards      map[string]net.Listener
+	forwardsMutex sync.Mutex
+}
+
+// Session is a single session channel of a user. A connection can have
+// multiple sessions (e.g. with ControlMaster), each with its own terminal
+type Session struct {
+	*User
+
+	Terminal *terminal.Terminal
+}
+
+// Container returns the running container of the user. nil if no session
+// has started a container yet or if it was stopped
+func (u *User) Container() *docker.SimpleContainer {
+	u.simpleContainerMutex.RLock()
+	defer u.simpleContainerMutex.RUnlock()
+
+	return u.simpleContainer
+}
+
+// setContainer sets the container of the user and notifies everyone who
+// is waiting for it. A nil container unsets it after it was stopped
+func (u *User) setContainer(container *docker.SimpleContainer) {
+	u.simpleContainerMutex.Lock()
+	u.simpleContainer = container
+	u.simpleContainerMutex.Unlock()
+
+	if container != nil {
+		u.containerOnce.Do(func() {
+			close(u.containerReady)
+		})
+	}
+}
+
+// waitContainer blocks until the user has a container. ok is false if the
+// connection was closed, the container was stopped or the timeout has passed
+// before
+func (u *User) waitContainer(timeout time.Duration) (container *docker.SimpleContainer, ok bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-u.containerReady:
+		container = u.Container()
+		return container, container != nil
+	case <-u.done:
+		return nil, false
+	case <-timer.C:
+		return nil, false
+	}
 }
 
 func GetUser(ip string) *User {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
 	for _, user := range users {
-		if container := user.Container; container != nil && container.Network.IP == ip {
+		if container := user.Container(); container != nil && container.Network.IP == ip {
 			return user
 		}
 	}
@@ -46,6 +129,67 @@ type extras struct {
 	containerID string
 }
 
+// resolveProfile returns the profile with the given name or, if name is
+// empty, the profile of the saved container. The image is only used by the
+// dynamic profile
+func resolveProfile(name, image, containerID string) (*c.Profile, bool) {
+	if name != "" {
+		if name == "dynamic" && image != "" {
+			tempDynamicProfile := dynamicProfile
+			tempDynamicProfile.Image = image
+			return &tempDynamicProfile, true
+		}
+		profile, ok := profiles.GetByName(name)
+		if !ok {
+			zap.S().Errorf("Failed to get profile %s", name)
+		}
+		return profile, ok
+	}
+
+	var profile *c.Profile
+	if containerID == "" {
+		return profile, true
+	}
+	if settings, err := database.GetDatabase().SettingsByContainerID(containerID); err == nil {
+		profile = savedContainerProfile(c.GetConfig(), containerID)
+		profile.NetworkMode = *settings.NetworkMode
+		profile.Configurable = *settings.Configurable
+		profile.RunLevel = *settings.RunLevel
+		profile.StartupInformation = *settings.StartupInformation
+		profile.ExitAfter = *settings.ExitAfter
+		profile.KeepOnExit = *settings.KeepOnExit
+	} else {
+		for _, container := range containers() {
+			if container.ContainerID == containerID {
+				profile = savedContainerProfile(c.GetConfig(), containerID)
+				profile.Password = regexp.MustCompile(c.GetConfig().Profile.Default.Password)
+			}
+		}
+	}
+	return profile, true
+}
+
+// savedContainerProfile returns a profile for the saved container with the
+// settings of the default profile
+func savedContainerProfile(config *c.Config, containerID string) *c.Profile {
+	profile := &c.Profile{
+		NetworkMode:        config.Profile.Default.NetworkMode,
+		Configurable:       config.Profile.Default.Configurable,
+		RunLevel:           config.Profile.Default.RunLevel,
+		StartupInformation: config.Profile.Default.StartupInformation,
+		ExitAfter:          config.Profile.Default.ExitAfter,
+		KeepOnExit:         config.Profile.Default.KeepOnExit,
+		ForwardAnyHost:     config.Profile.Default.ForwardAnyHost,
+		AcceptEnv:          config.Profile.Default.AcceptEnv,
+		Detachable:         config.Profile.Default.Detachable,
+		Banner:             config.Profile.Default.Banner,
+		Motd:               c.DefaultMotd(config),
+		ContainerID:        containerID,
+	}
+	profile.IdleTimeout, profile.MaxSessionDuration = c.DefaultSessionLimits(config)
+	return profile
+}
+
 func StartServing(config *c.Config, serverConfig *ssh.ServerConfig) (errChan chan error, closer func() error) {
 	errChan = make(chan error, 1)
 
@@ -86,6 +230,16 @@ func StartServing(config *c.Config, serverConfig *ssh.ServerConfig) (errChan cha
 		Network:  network,
 	}
 
+	var trustedProxies []*net.IPNet
+	for _, cidr := range config.SSH.TrustedProxies {
+		_, proxyNetwork, err := net.ParseCIDR(cidr)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to parse trusted proxy %s: %v", cidr, err)
+			return
+		}
+		trustedProxies = append(trustedProxies, proxyNetwork)
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.SSH.Port))
 	if err != nil {
 		errChan <- err
@@ -95,8 +249,6 @@ func StartServing(config *c.Config, serverConfig *ssh.ServerConfig) (errChan cha
 
 	var closed bool
 	go func() {
-		db := database.GetDatabase()
-
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
@@ -106,75 +258,92 @@ func StartServing(config *c.Config, serverConfig *ssh.ServerConfig) (errChan cha
 				zap.S().Errorf("Failed to accept new ssh user: %v", err)
 				continue
 			}
-			serverConn, chans, requests, err := ssh.NewServerConn(conn, serverConfig)
-			if err != nil {
-				zap.S().Errorf("Failed to establish new ssh connection: %v", err)
-				continue
-			}
-
-			idBytes := md5.Sum([]byte(strings.Split(serverConn.User(), ":")[0]))
-			idString := hex.EncodeToString(idBytes[:])
 
-			zap.S().Infof("New ssh connection from %s with %s (%s)", serverConn.RemoteAddr().String(), serverConn.ClientVersion(), idString)
+			// the handshake runs in its own goroutine, so slow or malicious
+			// clients can't block new connections
+			go func(conn net.Conn) {
+				conn.SetDeadline(time.Now().Add(handshakeTimeout))
 
-			var profile *c.Profile
-			if name, ok := serverConn.Permissions.CriticalOptions["profile"]; ok {
-				if name == "dynamic" {
-					if image, ok := serverConn.Permissions.CriticalOptions["image"]; ok {
-						tempDynamicProfile := dynamicProfile
-						tempDynamicProfile.Image = image
-						profile = &tempDynamicProfile
+				if config.SSH.ProxyProtocol {
+					proxiedConn, err := readProxyHeader(conn, trustedProxies)
+					if err != nil {
+						zap.S().Errorf("Failed to read proxy protocol header: %v", err)
+						conn.Close()
+						return
 					}
+					conn = proxiedConn
 				}
-				if profile == nil {
-					if profile, ok = profiles.GetByName(name); !ok {
-						zap.S().Errorf("Failed to get profile %s", name)
-						continue
-					}
+
+				ip := remoteIP(conn.RemoteAddr())
+				if err := connLimiter.accept(ip); err != nil {
+					zap.S().Infof("Rejected ssh connection from %s: %v", conn.RemoteAddr().String(), err)
+					conn.Close()
+					return
 				}
-			} else if containerID, ok := serverConn.Permissions.CriticalOptions["containerID"]; ok {
-				if settings, err := db.SettingsByContainerID(containerID); err == nil {
-					profile = &c.Profile{
-						NetworkMode:        *settings.NetworkMode,
-						Configurable:       *settings.Configurable,
-						RunLevel:           *settings.RunLevel,
-						StartupInformation: *settings.StartupInformation,
-						ExitAfter:          *settings.ExitAfter,
-						KeepOnExit:         *settings.KeepOnExit,
-						ContainerID:        containerID,
-					}
-				} else {
-					for _, container := range allContainers {
-						if container.ContainerID == containerID {
-							cconfig := c.GetConfig()
-							profile = &c.Profile{
-								Password:           regexp.MustCompile(cconfig.Profile.Default.Password),
-								NetworkMode:        cconfig.Profile.Default.NetworkMode,
-								Configurable:       cconfig.Profile.Default.Configurable,
-								RunLevel:           cconfig.Profile.Default.RunLevel,
-								StartupInformation: cconfig.Profile.Default.StartupInformation,
-								ExitAfter:          cconfig.Profile.Default.ExitAfter,
-								KeepOnExit:         cconfig.Profile.Default.KeepOnExit,
-								Image:              "",
-								ContainerID:        containerID,
-							}
-						}
+
+				serverConn, chans, requests, err := ssh.NewServerConn(conn, serverConfig)
+				connLimiter.authenticated(conn.RemoteAddr(), err == nil)
+				if err != nil {
+					zap.S().Errorf("Failed to establish new ssh connection: %v", err)
+					conn.Close()
+					return
+				}
+				conn.SetDeadline(time.Time{})
+
+				if _, ok := serverConn.Permissions.CriticalOptions["shadow"]; ok {
+					zap.S().Infof("New ssh shadow connection from %s with %s (%s)", serverConn.RemoteAddr().String(), serverConn.ClientVersion(), serverConn.Permissions.CriticalOptions["shadowName"])
+					go ssh.DiscardRequests(requests)
+					serveShadow(serverConn, chans)
+					return
+				}
+
+				idBytes := md5.Sum([]byte(strings.Split(serverConn.User(), ":")[0]))
+				idString := hex.EncodeToString(idBytes[:])
+
+				zap.S().Infof("New ssh connection from %s with %s (%s)", serverConn.RemoteAddr().String(), serverConn.ClientVersion(), idString)
+
+				options := serverConn.Permissions.CriticalOptions
+				profile, ok := resolveProfile(options["profile"], options["image"], options["containerID"])
+				if !ok {
+					return
+				}
+
+				// the user selects one of the containers when the first session
+				// is opened
+				var candidates []string
+				var freshProfile *c.Profile
+				if containerIDs, ok := options["containerIDs"]; ok {
+					candidates = strings.Split(containerIDs, ",")
+					if name, ok := options["fresh.profile"]; ok {
+						freshProfile, _ = resolveProfile(name, options["fresh.image"], "")
 					}
 				}
-			}
 
-			zap.S().Debugf("User %s has profile %s", idString, profile.Name())
+				zap.S().Debugf("User %s has profile %s", idString, profile.Name())
 
-			user := &User{
-				ServerConn: serverConn,
-				ID:         idString,
-				Terminal:   &terminal.Terminal{},
-				Profile:    profile,
-			}
-			users = append(users, user)
+				user := &User{
+					ServerConn:     serverConn,
+					ID:             idString,
+					Profile:        profile,
+					containerReady: make(chan struct{}),
+					done:           make(chan struct{}),
+					forwards:       map[string]net.Listener{},
+					candidates:     candidates,
+					freshProfile:   freshProfile,
+				}
+				usersMutex.Lock()
+				users = append(users, user)
+				usersMutex.Unlock()
 
-			go ssh.DiscardRequests(requests)
-			go handleChannels(chans, client, user)
+				go handleGlobalRequests(requests, user)
+				go announceHostKeys(user)
+				go handleChannels(chans, client, user)
+				go func() {
+					user.Wait()
+					close(user.done)
+					user.closeForwards()
+				}()
+			}(conn)
 		}
 	}()
 
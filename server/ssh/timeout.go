@@ -0,0 +1,81 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+// sessionWarning is how long before a disconnect because of the idle timeout
+// or the maximal session duration the user gets warned
+const sessionWarning = time.Minute
+
+// watchSessionLimits ends the session by calling cancel if it was idle for
+// longer than the profile's IdleTimeout or if it exceeds the profile's
+// MaxSessionDuration. The user gets warned in the terminal before. Blocks
+// until the session has ended or ctx is done
+func watchSessionLimits(ctx context.Context, session *Session, cancel context.CancelFunc) {
+	idleTimeout := session.Profile.IdleTimeout
+	maxSessionDuration := session.Profile.MaxSessionDuration
+	if idleTimeout == 0 && maxSessionDuration == 0 {
+		return
+	}
+
+	started := time.Now()
+	var idleWarned, durationWarned bool
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if maxSessionDuration > 0 {
+				left := maxSessionDuration - now.Sub(started)
+				if left <= 0 {
+					fmt.Fprintf(session.Terminal.ErrorWriter(), "\r\nThe maximal session duration of %s is reached, disconnecting\r\n", maxSessionDuration)
+					zap.S().Infof("Session of user %s reached the maximal session duration", session.ID)
+					cancel()
+					return
+				} else if left <= warningLead(maxSessionDuration) && !durationWarned {
+					fmt.Fprintf(session.Terminal.ErrorWriter(), "\r\nThe maximal session duration is reached in %s, you will be disconnected then\r\n", left.Round(time.Second))
+					durationWarned = true
+				}
+			}
+
+			if idleTimeout > 0 {
+				lastActivity := session.Terminal.LastActivity()
+				if lastActivity.Before(started) {
+					lastActivity = started
+				}
+				left := idleTimeout - now.Sub(lastActivity)
+				if left <= 0 {
+					fmt.Fprintf(session.Terminal.ErrorWriter(), "\r\nDisconnecting after %s of inactivity\r\n", idleTimeout)
+					zap.S().Infof("Session of user %s reached the idle timeout", session.ID)
+					cancel()
+					return
+				} else if left <= warningLead(idleTimeout) {
+					if !idleWarned {
+						fmt.Fprintf(session.Terminal.ErrorWriter(), "\r\nNo activity for %s, you will be disconnected in %s\r\n", now.Sub(lastActivity).Round(time.Second), left.Round(time.Second))
+						idleWarned = true
+					}
+				} else {
+					// the user was active since the last warning
+					idleWarned = false
+				}
+			}
+		}
+	}
+}
+
+// warningLead returns how long before the limit the user gets warned. Limits
+// shorter than two warning periods are warned at half their time
+func warningLead(limit time.Duration) time.Duration {
+	if limit < 2*sessionWarning {
+		return limit / 2
+	}
+	return sessionWarning
+}
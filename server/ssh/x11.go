@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"context"
+	"docker4ssh/docker"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+)
+
+const (
+	// x11DisplayOffset is the first display number which is tried to use
+	x11DisplayOffset = 10
+	x11MaxDisplays   = 1000
+	x11BasePort      = 6000
+)
+
+type X11ChannelPayload struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+// startX11Forwarding opens a x11 display which can be reached from within the
+// container and tunnels every connection to it back to the client. The
+// cookie of the client is written into an Xauthority file in the container.
+// Returns the environment variables which must be set for x11 clients and a
+// function to stop the forwarding
+func startX11Forwarding(ctx context.Context, session *Session, container *docker.InteractiveContainer) ([]string, func(), error) {
+	x11 := session.Terminal.X11
+
+	host, err := gatewayHost(container.SimpleContainer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var listener net.Listener
+	var display int
+	for display = x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		if listener, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(x11BasePort+display))); err == nil {
+			break
+		}
+	}
+	if listener == nil {
+		return nil, nil, fmt.Errorf("no free x11 display found")
+	}
+
+	xauthority, err := container.WriteXauthority(ctx, display, x11.AuthProtocol, x11.AuthCookie)
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+
+	go func() {
+		defer listener.Close()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if x11.SingleConnection {
+				listener.Close()
+			}
+
+			go func() {
+				addr := conn.RemoteAddr().(*net.TCPAddr)
+				ch, requests, err := session.OpenChannel("x11", ssh.Marshal(X11ChannelPayload{
+					OriginatorAddress: addr.IP.String(),
+					OriginatorPort:    uint32(addr.Port),
+				}))
+				if err != nil {
+					zap.S().Debugf("Client of user %s rejected x11 connection: %v", session.ID, err)
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+
+				pipe(ch, conn)
+			}()
+		}
+	}()
+
+	zap.S().Debugf("Started x11 forwarding for user %s on %s", session.ID, listener.Addr().String())
+
+	return []string{
+		fmt.Sprintf("DISPLAY=%s:%d.%d", host, display, x11.Screen),
+		fmt.Sprintf("XAUTHORITY=%s", xauthority),
+	}, func() {
+		listener.Close()
+		if err := container.RemoveFile(context.Background(), xauthority); err != nil {
+			zap.S().Debugf("Failed to remove xauthority file of user %s: %v", session.ID, err)
+		}
+	}, nil
+}
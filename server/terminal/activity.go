@@ -0,0 +1,60 @@
+package terminal
+
+import (
+	"io"
+	"time"
+)
+
+type activityReader struct {
+	io.Reader
+	terminal *Terminal
+}
+
+func (ar activityReader) Read(p []byte) (n int, err error) {
+	n, err = ar.Reader.Read(p)
+	if n > 0 {
+		ar.terminal.touch()
+	}
+	return
+}
+
+type activityWriter struct {
+	io.Writer
+	terminal *Terminal
+}
+
+func (aw activityWriter) Write(p []byte) (n int, err error) {
+	n, err = aw.Writer.Write(p)
+	if n > 0 {
+		aw.terminal.touch()
+	}
+	return
+}
+
+// ActivityReader returns a reader which marks the terminal as active every
+// time data is read from r
+func (t *Terminal) ActivityReader(r io.Reader) io.Reader {
+	return activityReader{Reader: r, terminal: t}
+}
+
+// ActivityWriter returns a writer which marks the terminal as active every
+// time data is written to w
+func (t *Terminal) ActivityWriter(w io.Writer) io.Writer {
+	return activityWriter{Writer: w, terminal: t}
+}
+
+// LastActivity returns the time of the last input or output which went
+// through an activity reader or writer. Zero if there was none yet
+func (t *Terminal) LastActivity() time.Time {
+	t.activityMutex.Lock()
+	defer t.activityMutex.Unlock()
+
+	return t.lastActivity
+}
+
+func (t *Terminal) touch() {
+	t.activityMutex.Lock()
+	defer t.activityMutex.Unlock()
+
+	t.lastActivity = time.Now()
+}
@@ -0,0 +1,188 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordingHeader is the first line of an asciicast v2 file
+type RecordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes the output, optionally the input, and the resize events of
+// a terminal as asciicast v2 file
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+	input   bool
+	// pending contains incomplete utf-8 sequences at the end of the last
+	// output or input which are completed by the next write
+	pending map[string][]byte
+	closed  bool
+}
+
+// NewRecorder creates the recording file and writes the header to it. If
+// input is true, the input of the terminal is recorded too
+func NewRecorder(file string, header RecordingHeader, input bool) (*Recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		file:    f,
+		writer:  bufio.NewWriter(f),
+		started: time.Now(),
+		input:   input,
+		pending: map[string][]byte{},
+	}
+	header.Version = 2
+	if header.Width == 0 || header.Height == 0 {
+		header.Width, header.Height = 80, 24
+	}
+	if header.Timestamp == 0 {
+		header.Timestamp = r.started.Unix()
+	}
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(r.writer, "%s\n", rawHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Output records p as output
+func (r *Recorder) Output(p []byte) {
+	r.event("o", p)
+}
+
+// Input records p as input if the recorder records input
+func (r *Recorder) Input(p []byte) {
+	if r.input {
+		r.event("i", p)
+	}
+}
+
+// Resize records a resize of the terminal
+func (r *Recorder) Resize(width, height uint32) {
+	r.event("r", []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// Close flushes and closes the recording file
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+func (r *Recorder) event(code string, p []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	data := append(r.pending[code], p...)
+	// json strings must be valid utf-8, so a multibyte character which is
+	// split across two writes is kept until it is complete
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	r.pending[code] = append([]byte(nil), data[end:]...)
+	if end == 0 {
+		return
+	}
+
+	rawEvent, err := json.Marshal([]interface{}{time.Since(r.started).Seconds(), code, string(data[:end])})
+	if err != nil {
+		return
+	}
+	r.writer.Write(rawEvent)
+	// the events are buffered to not hit the disk on every keystroke, they
+	// are flushed when the buffer is full or the recorder gets closed
+	r.writer.WriteByte('\n')
+}
+
+type recordWriter struct {
+	io.Writer
+	record func(p []byte)
+}
+
+func (rw recordWriter) Write(p []byte) (n int, err error) {
+	n, err = rw.Writer.Write(p)
+	if n > 0 {
+		rw.record(p[:n])
+	}
+	return
+}
+
+// SetRecorder sets the recorder which records the session. A nil recorder
+// stops recording
+func (t *Terminal) SetRecorder(recorder *Recorder) {
+	t.resizeMutex.Lock()
+	defer t.resizeMutex.Unlock()
+
+	t.recorder = recorder
+}
+
+func (t *Terminal) getRecorder() *Recorder {
+	t.resizeMutex.Lock()
+	defer t.resizeMutex.Unlock()
+
+	return t.recorder
+}
+
+// RecordWriter returns a writer which writes to w and records everything
+// written as output. If the terminal is not recorded, w is returned
+func (t *Terminal) RecordWriter(w io.Writer) io.Writer {
+	recorder := t.getRecorder()
+	if recorder == nil {
+		return w
+	}
+	return recordWriter{Writer: w, record: recorder.Output}
+}
+
+// RecordInput returns a writer which writes to w, the input of the process,
+// and records everything written as input. If the terminal is not recorded,
+// w is returned
+func (t *Terminal) RecordInput(w io.Writer) io.Writer {
+	recorder := t.getRecorder()
+	if recorder == nil {
+		return w
+	}
+	return recordWriter{Writer: w, record: recorder.Input}
+}
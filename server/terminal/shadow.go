@@ -0,0 +1,165 @@
+package terminal
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// shadowQueueSize is the number of output chunks which are queued for a
+// shadow. Shadows which fall further behind get removed, so a slow shadow
+// never slows down the terminal itself
+const shadowQueueSize = 256
+
+// Shadow is a client which watches the output of a terminal
+type Shadow struct {
+	Name    string
+	Copilot bool
+
+	writer io.Writer
+	queue  chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Done is closed when the shadow was removed or the terminal has ended
+func (s *Shadow) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Shadow) end() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *Shadow) writeQueue() {
+	for {
+		select {
+		case p := <-s.queue:
+			if _, err := s.writer.Write(p); err != nil {
+				// the shadow has disconnected
+				s.end()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+type shadowWriter struct {
+	io.Writer
+	terminal *Terminal
+}
+
+func (sw shadowWriter) Write(p []byte) (int, error) {
+	n, err := sw.Writer.Write(p)
+	if n > 0 {
+		sw.terminal.writeShadows(p[:n])
+	}
+	return n, err
+}
+
+// ShadowWriter returns a writer which writes to w and all shadows of the
+// terminal
+func (t *Terminal) ShadowWriter(w io.Writer) io.Writer {
+	return shadowWriter{Writer: w, terminal: t}
+}
+
+// AddShadow fans out the terminal output to w until the shadow gets removed
+// or the terminal ends
+func (t *Terminal) AddShadow(name string, copilot bool, w io.Writer) *Shadow {
+	t.shadowMutex.Lock()
+	defer t.shadowMutex.Unlock()
+
+	shadow := &Shadow{
+		Name:    name,
+		Copilot: copilot,
+		writer:  w,
+		queue:   make(chan []byte, shadowQueueSize),
+		done:    make(chan struct{}),
+	}
+	if t.shadowsEnded {
+		shadow.end()
+	} else {
+		t.shadows = append(t.shadows, shadow)
+		go shadow.writeQueue()
+	}
+	return shadow
+}
+
+// RemoveShadow stops writing the terminal output to the shadow
+func (t *Terminal) RemoveShadow(shadow *Shadow) {
+	t.shadowMutex.Lock()
+	defer t.shadowMutex.Unlock()
+
+	for i, s := range t.shadows {
+		if s == shadow {
+			t.shadows = append(t.shadows[:i], t.shadows[i+1:]...)
+			break
+		}
+	}
+	shadow.end()
+}
+
+// Shadows returns all shadows of the terminal
+func (t *Terminal) Shadows() []*Shadow {
+	t.shadowMutex.Lock()
+	defer t.shadowMutex.Unlock()
+
+	return append([]*Shadow{}, t.shadows...)
+}
+
+// EndShadows removes all shadows, must be called when the terminal has ended
+func (t *Terminal) EndShadows() {
+	t.shadowMutex.Lock()
+	defer t.shadowMutex.Unlock()
+
+	for _, shadow := range t.shadows {
+		shadow.end()
+	}
+	t.shadows = nil
+	t.shadowsEnded = true
+}
+
+func (t *Terminal) writeShadows(p []byte) {
+	t.shadowMutex.Lock()
+	defer t.shadowMutex.Unlock()
+
+	for i := 0; i < len(t.shadows); i++ {
+		shadow := t.shadows[i]
+		select {
+		case <-shadow.done:
+		case shadow.queue <- append([]byte{}, p...):
+			continue
+		default:
+			// the shadow is too slow
+			shadow.end()
+		}
+		t.shadows = append(t.shadows[:i], t.shadows[i+1:]...)
+		i--
+	}
+}
+
+// SetInput sets the writer which receives the input of copilots. It is the
+// same writer the input of the terminal itself is copied to
+func (t *Terminal) SetInput(w io.Writer) {
+	t.shadowMutex.Lock()
+	defer t.shadowMutex.Unlock()
+
+	t.input = w
+}
+
+// WriteInput writes the input of a copilot to the process of the terminal
+func (t *Terminal) WriteInput(p []byte) (int, error) {
+	t.shadowMutex.Lock()
+	input := t.input
+	t.shadowMutex.Unlock()
+
+	if input == nil {
+		return 0, fmt.Errorf("terminal has no input")
+	}
+	t.touch()
+	return input.Write(p)
+}
@@ -1,9 +1,123 @@
 package terminal
 
-import "io"
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// X11 contains the parameters of a x11 forwarding request
+type X11 struct {
+	SingleConnection bool
+	AuthProtocol     string
+	// AuthCookie is the hex encoded authentication cookie
+	AuthCookie string
+	Screen     uint32
+}
 
 type Terminal struct {
 	io.ReadWriter
 
+	// Stderr receives the error output if no pty was requested.
+	// If nil, error output is written to ReadWriter
+	Stderr io.Writer
+
+	// Pty is true if the client requested a pseudo terminal
+	Pty bool
+
+	// Term is the TERM environment variable value of the client
+	Term string
+
+	// Closed gets closed when the client has closed the session. Unlike the
+	// end of the input, which may only be a half-close, nothing is read from
+	// or written to the client afterwards. May be nil
+	Closed chan struct{}
+
+	// Command is the command requested via exec. If empty, the default
+	// shell is started
+	Command string
+
+	// Subsystem is the name of the requested subsystem, e.g. 'sftp'.
+	// Empty if no subsystem was requested
+	Subsystem string
+
+	// AgentForwarding is true if the client requested ssh agent forwarding
+	AgentForwarding bool
+
+	// X11 is set if the client requested x11 forwarding
+	X11 *X11
+
+	// User is the name the client has logged in with
+	User string
+
+	// Env contains additional environment variables in the 'KEY=value' format
+	Env []string
+
+	// Detachable is true if an interactive shell should keep running after
+	// the client has disconnected
+	Detachable bool
+
+	// DetachTimeout is how long a detached shell is kept before it gets
+	// closed. 0 keeps it until the container stops
+	DetachTimeout time.Duration
+
 	Width, Height uint32
+
+	// resizeMutex guards Width, Height, resizeHandler and recorder, they are
+	// changed by window-change requests while the session is served
+	resizeMutex   sync.Mutex
+	resizeHandler func(width, height uint32)
+	recorder      *Recorder
+
+	activityMutex sync.Mutex
+	lastActivity  time.Time
+
+	shadowMutex  sync.Mutex
+	shadows      []*Shadow
+	shadowsEnded bool
+	input        io.Writer
+}
+
+// ErrorWriter returns the writer where error output should be written to
+func (t *Terminal) ErrorWriter() io.Writer {
+	if t.Stderr != nil {
+		return t.Stderr
+	}
+	return t.ReadWriter
+}
+
+// Resize updates the terminal size and notifies the resize handler if set
+func (t *Terminal) Resize(width, height uint32) {
+	t.resizeMutex.Lock()
+	defer t.resizeMutex.Unlock()
+
+	t.Width = width
+	t.Height = height
+	if t.recorder != nil {
+		t.recorder.Resize(width, height)
+	}
+	if t.resizeHandler != nil {
+		t.resizeHandler(width, height)
+	}
+}
+
+// Size returns the current size of the terminal
+func (t *Terminal) Size() (width, height uint32) {
+	t.resizeMutex.Lock()
+	defer t.resizeMutex.Unlock()
+
+	return t.Width, t.Height
+}
+
+// OnResize sets a handler which gets called every time the terminal is
+// resized. If the terminal has already a size, the handler gets called
+// immediately. A nil handler removes the current one
+func (t *Terminal) OnResize(handler func(width, height uint32)) {
+	t.resizeMutex.Lock()
+	defer t.resizeMutex.Unlock()
+
+	t.resizeHandler = handler
+	if handler != nil && t.Width > 0 && t.Height > 0 {
+		handler(t.Width, t.Height)
+	}
 }
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods a code may differ from the current
+	// one to compensate clock drift of the client
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret generates a new random base32 encoded totp secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// CheckTOTPSecret checks if secret is a valid base32 encoded totp secret
+func CheckTOTPSecret(secret string) error {
+	_, err := decodeTOTPSecret(secret)
+	return err
+}
+
+// ValidateTOTP checks if code is a valid totp code of the base32 encoded
+// secret at the given time
+func ValidateTOTP(secret, code string, t time.Time) bool {
+	counter := t.Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		expected, err := totpCode(secret, uint64(counter+i))
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.TrimSpace(code))) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPURI returns the otpauth uri of the secret which can be imported by
+// authenticator apps
+func TOTPURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("period", fmt.Sprint(totpPeriod))
+	query.Set("digits", fmt.Sprint(totpDigits))
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "=")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid totp secret: %v", err)
+	} else if len(key) == 0 {
+		return nil, fmt.Errorf("empty totp secret")
+	}
+	return key, nil
+}
+
+// totpCode calculates the totp code (RFC 6238) of the secret for the counter
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation as described in RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
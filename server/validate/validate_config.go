@@ -1,6 +1,8 @@
 package validate
 
 import (
+	"bytes"
+	"debug/elf"
 	"docker4ssh/config"
 	"docker4ssh/docker"
 	"docker4ssh/utils"
@@ -13,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func NewConfigValidator(cli *client.Client, strict bool, config *config.Config) *ConfigValidator {
@@ -37,6 +40,7 @@ func (cv *ConfigValidator) Validate() *ValidatorResult {
 	errors = append(errors, cv.ValidateProfile().Errors...)
 	errors = append(errors, cv.ValidateAPI().Errors...)
 	errors = append(errors, cv.ValidateSSH().Errors...)
+	errors = append(errors, cv.ValidateRecording().Errors...)
 	errors = append(errors, cv.ValidateDatabase().Errors...)
 	errors = append(errors, cv.ValidateNetwork().Errors...)
 	errors = append(errors, cv.ValidateLogging().Errors...)
@@ -74,6 +78,16 @@ func (cv *ConfigValidator) validateProfileDefault() []*ValidateError {
 	if docker.User > runLevel || runLevel > docker.Forever {
 		errors = append(errors, newValidateError("profile.default", "RunLevel", profileDefault.RunLevel, "is not a valid run level", nil))
 	}
+	for _, pattern := range profileDefault.AcceptEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errors = append(errors, newValidateError("profile.default", "AcceptEnv", pattern, "not a valid pattern", err))
+		}
+	}
+	errors = append(errors, validateSessionDuration("profile.default", "IdleTimeout", profileDefault.IdleTimeout)...)
+	errors = append(errors, validateSessionDuration("profile.default", "MaxSessionDuration", profileDefault.MaxSessionDuration)...)
+	if _, err := config.ParseMotd(profileDefault.Motd); err != nil {
+		errors = append(errors, newValidateError("profile.default", "Motd", profileDefault.Motd, "not a valid template", err))
+	}
 
 	return errors
 }
@@ -97,10 +111,54 @@ func (cv *ConfigValidator) validateProfileDynamic() []*ValidateError {
 	if docker.User > runLevel || runLevel > docker.Forever {
 		errors = append(errors, newValidateError("profile.dynamic", "RunLevel", profileDynamic.RunLevel, "is not a valid run level", nil))
 	}
+	for _, authorizedKey := range profileDynamic.AuthorizedKeys {
+		if _, _, _, _, err := s.ParseAuthorizedKey([]byte(authorizedKey)); err != nil {
+			errors = append(errors, newValidateError("profile.dynamic", "AuthorizedKeys", authorizedKey, "not a valid authorized key", err))
+		}
+	}
+	for _, pattern := range profileDynamic.AcceptEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errors = append(errors, newValidateError("profile.dynamic", "AcceptEnv", pattern, "not a valid pattern", err))
+		}
+	}
+	if profileDynamic.TOTPSecret != "" {
+		if err := utils.CheckTOTPSecret(profileDynamic.TOTPSecret); err != nil {
+			errors = append(errors, newValidateError("profile.dynamic", "TOTPSecret", profileDynamic.TOTPSecret, "not a valid totp secret", err))
+		}
+	}
+	for _, cidr := range profileDynamic.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errors = append(errors, newValidateError("profile.dynamic", "AllowFrom", cidr, "not a valid cidr", err))
+		}
+	}
+	for _, cidr := range profileDynamic.DenyFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errors = append(errors, newValidateError("profile.dynamic", "DenyFrom", cidr, "not a valid cidr", err))
+		}
+	}
+	errors = append(errors, validateSessionDuration("profile.dynamic", "IdleTimeout", profileDynamic.IdleTimeout)...)
+	errors = append(errors, validateSessionDuration("profile.dynamic", "MaxSessionDuration", profileDynamic.MaxSessionDuration)...)
+	if _, err := config.ParseMotd(profileDynamic.Motd); err != nil {
+		errors = append(errors, newValidateError("profile.dynamic", "Motd", profileDynamic.Motd, "not a valid template", err))
+	}
 
 	return errors
 }
 
+// validateSessionDuration checks if the value is empty (no limit) or a
+// non-negative duration
+func validateSessionDuration(section, key, value string) []*ValidateError {
+	if value == "" {
+		return nil
+	}
+	if duration, err := time.ParseDuration(value); err != nil {
+		return []*ValidateError{newValidateError(section, key, value, "invalid duration", err)}
+	} else if duration < 0 {
+		return []*ValidateError{newValidateError(section, key, value, "must not be negative", nil)}
+	}
+	return nil
+}
+
 func (cv *ConfigValidator) ValidateAPI() *ValidatorResult {
 	api := cv.Config.Api
 	errors := make([]*ValidateError, 0)
@@ -142,25 +200,182 @@ func (cv *ConfigValidator) ValidateSSH() *ValidatorResult {
 		errors = append(errors, newValidateError("api", "Port", ssh.Port, "port is already in use", nil))
 	}
 
-	path := absolutePath("", ssh.Keyfile)
-	if msg, err, ok := fileOk(path); !ok {
-		errors = append(errors, newValidateError("ssh", "Keyfile", path, msg, err))
-	} else {
+	keyfiles, generated := cv.Config.HostKeyfiles()
+	if generated {
+		// missing keys get generated on startup
+		if info, err := os.Stat(ssh.HostKeyDir); err == nil && !info.IsDir() {
+			errors = append(errors, newValidateError("ssh", "HostKeyDir", ssh.HostKeyDir, "file is not a directory", nil))
+		}
+	}
+	for _, keyfile := range keyfiles {
+		path := absolutePath("", keyfile)
+		if _, err := os.Stat(path); generated && os.IsNotExist(err) {
+			continue
+		}
+		if msg, err, ok := fileOk(path); !ok {
+			errors = append(errors, newValidateError("ssh", "Keyfile", path, msg, err))
+			continue
+		}
 		keyBytes, err := ioutil.ReadFile(path)
 		if err != nil {
 			panic(fmt.Sprintf("failed to read file %s: %v", path, err))
 		}
 		if ssh.Passphrase == "" {
 			if _, err = s.ParsePrivateKey(keyBytes); err != nil {
-				errors = append(errors, newValidateError("ssh", "Passphrase", ssh.Passphrase, "failed to parse ssh keyfile without password", err))
+				errors = append(errors, newValidateError("ssh", "Passphrase", ssh.Passphrase, fmt.Sprintf("failed to parse ssh keyfile %s without password", path), err))
 			}
 		} else {
 			if _, err = s.ParsePrivateKeyWithPassphrase(keyBytes, []byte(ssh.Passphrase)); err != nil {
-				errors = append(errors, newValidateError("ssh", "Passphrase", ssh.Passphrase, "failed to parse ssh keyfile with password", err))
+				errors = append(errors, newValidateError("ssh", "Passphrase", ssh.Passphrase, fmt.Sprintf("failed to parse ssh keyfile %s with password", path), err))
+			}
+		}
+	}
+
+	if ssh.SocketDir != "" {
+		// the directory gets created if it does not exist
+		if info, err := os.Stat(ssh.SocketDir); err == nil && !info.IsDir() {
+			errors = append(errors, newValidateError("ssh", "SocketDir", ssh.SocketDir, "file is not a directory", nil))
+		}
+	}
+
+	if ssh.TrustedUserCAKeys != "" {
+		path := absolutePath("", ssh.TrustedUserCAKeys)
+		if msg, err, ok := fileOk(path); !ok {
+			errors = append(errors, newValidateError("ssh", "TrustedUserCAKeys", path, msg, err))
+		} else {
+			keyBytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				panic(fmt.Sprintf("failed to read file %s: %v", path, err))
+			}
+			for len(bytes.TrimSpace(keyBytes)) > 0 {
+				if _, _, _, keyBytes, err = s.ParseAuthorizedKey(keyBytes); err != nil {
+					errors = append(errors, newValidateError("ssh", "TrustedUserCAKeys", path, "contains an invalid ca key", err))
+					break
+				}
+			}
+		}
+	}
+	if ssh.RevokedSerials != "" {
+		path := absolutePath("", ssh.RevokedSerials)
+		if msg, err, ok := fileOk(path); !ok {
+			errors = append(errors, newValidateError("ssh", "RevokedSerials", path, msg, err))
+		}
+	}
+
+	for _, cidr := range ssh.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errors = append(errors, newValidateError("ssh", "TrustedProxies", cidr, "not a valid cidr", err))
+		}
+	}
+	if ssh.ProxyProtocol && len(ssh.TrustedProxies) == 0 {
+		errors = append(errors, newValidateError("ssh", "TrustedProxies", ssh.TrustedProxies, "no trusted proxies are configured, so the proxy protocol header is never read", nil))
+	}
+
+	for _, shadowKeys := range []struct {
+		key   string
+		value []string
+	}{
+		{"ViewerKeys", ssh.Shadow.ViewerKeys},
+		{"CopilotKeys", ssh.Shadow.CopilotKeys},
+	} {
+		for _, authorizedKey := range shadowKeys.value {
+			if _, _, _, _, err := s.ParseAuthorizedKey([]byte(authorizedKey)); err != nil {
+				errors = append(errors, newValidateError("ssh.shadow", shadowKeys.key, authorizedKey, "not a valid authorized key", err))
 			}
 		}
 	}
 
+	if ssh.SFTP.Binary != "" {
+		path := absolutePath("", ssh.SFTP.Binary)
+		if msg, err, ok := fileOk(path); !ok {
+			errors = append(errors, newValidateError("ssh.sftp", "Binary", path, msg, err))
+		} else if msg, err, ok = staticBinaryOk(path); !ok {
+			errors = append(errors, newValidateError("ssh.sftp", "Binary", path, msg, err))
+		}
+	}
+
+	errors = append(errors, cv.validateSSHCrypto()...)
+	errors = append(errors, cv.validateSSHLimit()...)
+
+	return &ValidatorResult{
+		Strict: cv.Strict,
+		Errors: errors,
+	}
+}
+
+func (cv *ConfigValidator) validateSSHCrypto() []*ValidateError {
+	crypto := cv.Config.SSH.Crypto
+	errors := make([]*ValidateError, 0)
+
+	if _, ok := config.CryptoPresets[crypto.Preset]; crypto.Preset != "" && !ok {
+		errors = append(errors, newValidateError("ssh.crypto", "Preset", crypto.Preset, "not a valid preset", nil))
+	}
+	for _, algorithms := range []struct {
+		key   string
+		value []string
+		known []string
+	}{
+		{"KeyExchanges", crypto.KeyExchanges, config.KnownKeyExchanges},
+		{"Ciphers", crypto.Ciphers, config.KnownCiphers},
+		{"MACs", crypto.MACs, config.KnownMACs},
+		{"HostKeyAlgorithms", crypto.HostKeyAlgorithms, config.KnownHostKeyAlgorithms},
+	} {
+		for _, algorithm := range algorithms.value {
+			if !contains(algorithms.known, algorithm) {
+				errors = append(errors, newValidateError("ssh.crypto", algorithms.key, algorithm, "unknown algorithm", nil))
+			}
+		}
+	}
+
+	return errors
+}
+
+func (cv *ConfigValidator) validateSSHLimit() []*ValidateError {
+	limit := cv.Config.SSH.Limit
+	errors := make([]*ValidateError, 0)
+
+	if limit.MaxAuthFailures < 0 {
+		errors = append(errors, newValidateError("ssh.limit", "MaxAuthFailures", limit.MaxAuthFailures, "must not be negative", nil))
+	}
+	if limit.MaxUnauthenticated < 0 {
+		errors = append(errors, newValidateError("ssh.limit", "MaxUnauthenticated", limit.MaxUnauthenticated, "must not be negative", nil))
+	}
+	if limit.MaxHandshakes < 0 {
+		errors = append(errors, newValidateError("ssh.limit", "MaxHandshakes", limit.MaxHandshakes, "must not be negative", nil))
+	}
+	for _, duration := range []struct {
+		key   string
+		value string
+	}{
+		{"FailureWindow", limit.FailureWindow},
+		{"BanDuration", limit.BanDuration},
+	} {
+		if duration.value == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(duration.value); err != nil {
+			errors = append(errors, newValidateError("ssh.limit", duration.key, duration.value, "invalid duration", err))
+		} else if parsed <= 0 {
+			errors = append(errors, newValidateError("ssh.limit", duration.key, duration.value, "must be positive", nil))
+		}
+	}
+
+	return errors
+}
+
+func (cv *ConfigValidator) ValidateRecording() *ValidatorResult {
+	recording := cv.Config.Recording
+	errors := make([]*ValidateError, 0)
+
+	if recording.Dir != "" {
+		// the directory gets created if it does not exist
+		if info, err := os.Stat(recording.Dir); err == nil && !info.IsDir() {
+			errors = append(errors, newValidateError("recording", "Dir", recording.Dir, "file is not a directory", nil))
+		}
+	} else if recording.Input {
+		errors = append(errors, newValidateError("recording", "Input", "true", "input can only be recorded if Dir is set", nil))
+	}
+
 	return &ValidatorResult{
 		Strict: cv.Strict,
 		Errors: errors,
@@ -235,6 +450,15 @@ func (cv *ConfigValidator) ValidateLogging() *ValidatorResult {
 	}
 }
 
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func isPortFree(port uint16) bool {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if listener != nil {
@@ -252,6 +476,23 @@ func absolutePath(parentPath, filePath string) (path string) {
 	return
 }
 
+// staticBinaryOk checks if path is a statically linked executable. A dynamically
+// linked one would need the libraries of the host inside the container
+func staticBinaryOk(path string) (string, error, bool) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return "not an elf executable", err, false
+	}
+	defer file.Close()
+
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return "not statically linked", nil, false
+		}
+	}
+	return "", nil, true
+}
+
 func fileOk(path string) (string, error, bool) {
 	if info, err := os.Stat(path); os.IsNotExist(err) {
 		return "file does not exist", err, false